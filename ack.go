@@ -0,0 +1,169 @@
+package broadcaster
+
+import "time"
+
+// A PendingMessage is a message that was sent to a client, but not yet
+// acknowledged. See Server.RequireAck.
+type PendingMessage struct {
+	Message
+
+	// When the message was last sent
+	Sent time.Time `json:"sent"`
+}
+
+// Pending messages are stored per connection, keyed by id and channel.
+func pendingField(channel, id string) string {
+	return id + " " + channel
+}
+
+func (s *Server) requiresAck(m Message) bool {
+	// Messages published directly on the backend have no id to ack
+	return s.RequireAck != nil && m.ID != "" && s.RequireAck(m.Channel)
+}
+
+// Converts messages for sending to a connection. Messages that need to be
+// acknowledged are kept under the pending key of the connection until the
+// client does so.
+func (s *Server) deliver(key string, messages []Message) []ClientMessage {
+	result := make([]ClientMessage, 0, len(messages))
+	pending := make([]PendingMessage, 0)
+	for _, m := range messages {
+		msg := newBroadcastMessage(m)
+		if key != "" && s.requiresAck(m) {
+			pending = append(pending, PendingMessage{
+				Message: m,
+				Sent:    time.Now(),
+			})
+			msg["ack"] = true
+		}
+		result = append(result, msg)
+	}
+
+	// Can't do much when this fails: the messages are still delivered,
+	// they just won't be redelivered.
+	if len(pending) > 0 {
+		s.Backend.AddPending(key, pending, s.AckTTL)
+	}
+	return result
+}
+
+func (s *Server) ack(key string, m ClientMessage) error {
+	return s.Backend.RemovePending(key, m.Channel(), m.ID())
+}
+
+// Moves the unacknowledged messages of a previous connection to the new one
+// and returns them for redelivery, if the subscribe request asks for it.
+// Connections are identified by their pending key, which only the client
+// knows: unlike the session token, it's never shared.
+func (s *Server) resume(key, channel string, m ClientMessage) ([]ClientMessage, error) {
+	previous, _ := m["resume"].(string)
+	if previous == "" || previous == key {
+		return nil, nil
+	}
+	if s.RequireAck == nil || !s.RequireAck(channel) {
+		return nil, nil
+	}
+
+	pending, err := s.Backend.GetPending([]string{previous})
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0)
+	for _, p := range pending[previous] {
+		if p.Channel != channel {
+			continue
+		}
+
+		err := s.Backend.RemovePending(previous, p.Channel, p.ID)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, p.Message)
+	}
+	return s.deliver(key, messages), nil
+}
+
+// Keeps track of the pending keys of the connections on this node, for
+// redelivery.
+func (s *Server) trackPending(key, token string) {
+	s.pending_lock.Lock()
+	defer s.pending_lock.Unlock()
+
+	if s.pending_keys == nil {
+		s.pending_keys = make(map[string]*pendingOwner)
+	}
+	owner, ok := s.pending_keys[key]
+	if !ok {
+		owner = &pendingOwner{token: token}
+		s.pending_keys[key] = owner
+	}
+	owner.refs++
+}
+
+func (s *Server) untrackPending(key string) {
+	s.pending_lock.Lock()
+	defer s.pending_lock.Unlock()
+
+	owner, ok := s.pending_keys[key]
+	if !ok {
+		return
+	}
+	owner.refs--
+	if owner.refs == 0 {
+		delete(s.pending_keys, key)
+	}
+}
+
+// Session token of a pending key, tracked while it has connections (a
+// long-poll session can briefly have more than one).
+type pendingOwner struct {
+	token string
+	refs  int
+}
+
+func (s *Server) runRedelivery() {
+	if s.RequireAck == nil {
+		return
+	}
+
+	for {
+		select {
+		case <-time.After(s.AckTimeout / 2):
+		case <-s.quit:
+			return
+		}
+
+		s.redeliver()
+	}
+}
+
+// Sends messages that weren't acknowledged in time again, for connections
+// on this node.
+func (s *Server) redeliver() {
+	s.pending_lock.Lock()
+	keys := make([]string, 0, len(s.pending_keys))
+	tokens := make(map[string]string)
+	for key, owner := range s.pending_keys {
+		keys = append(keys, key)
+		tokens[key] = owner.token
+	}
+	s.pending_lock.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	pending, err := s.Backend.GetPending(keys)
+	if err != nil {
+		return
+	}
+
+	now := time.Now()
+	for key, messages := range pending {
+		for _, p := range messages {
+			if now.Sub(p.Sent) >= s.AckTimeout {
+				s.hub.deliver(tokens[key], p.Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package broadcaster
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Identity of an authenticated client, see Authenticator.
+type Identity struct {
+	UserID string                 `json:"userId"`
+	Roles  []string               `json:"roles,omitempty"`
+	Claims map[string]interface{} `json:"claims,omitempty"`
+
+	// When the credentials expire, zero if they don't. Clients are
+	// disconnected unless they send new credentials in time, see
+	// Client.Reauth.
+	Expires time.Time `json:"expires"`
+}
+
+// HasRole returns whether the identity has the given role.
+func (i *Identity) HasRole(role string) bool {
+	if i == nil {
+		return false
+	}
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns whether the credentials have expired.
+func (i *Identity) Expired() bool {
+	return i != nil && !i.Expires.IsZero() && time.Now().After(i.Expires)
+}
+
+// An Authenticator checks the data clients send when connecting (see
+// Client.AuthData). Returned errors are sent to the client as the reason.
+type Authenticator interface {
+	Authenticate(data map[string]interface{}) (*Identity, error)
+}
+
+// AuthenticatorFunc allows using a function as an Authenticator.
+type AuthenticatorFunc func(data map[string]interface{}) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(data map[string]interface{}) (*Identity, error) {
+	return f(data)
+}
+
+// Session key of the identity
+const identityKey = "__identity"
+
+// Session key of the resume key: pending messages are stored under it, see
+// Server.resume. Sent to the client in authOk.
+const resumeKey = "__resume"
+
+// Authenticates a client with the Authenticator or CanConnect. The identity
+// is nil when no Authenticator is set.
+func (s *Server) authenticate(data ClientMessage) (*Identity, error) {
+	if s.Authenticator == nil {
+		if s.CanConnect != nil && !s.CanConnect(data) {
+			return nil, errors.New("Unauthorized")
+		}
+		return nil, nil
+	}
+
+	identity, err := s.Authenticator.Authenticate(data)
+	if err != nil {
+		return nil, err
+	}
+	if identity == nil {
+		return nil, errors.New("Unauthorized")
+	}
+	if identity.Expired() {
+		return nil, errors.New("Credentials expired")
+	}
+	return identity, nil
+}
+
+// Checks new credentials sent by a client, they have to be for the same
+// user.
+func (s *Server) reauthenticate(current *Identity, data ClientMessage) (*Identity, error) {
+	identity, err := s.authenticate(data)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && identity != nil && current.UserID != identity.UserID {
+		return nil, errors.New("Identity changed")
+	}
+	return identity, nil
+}
+
+// Auth data sent by a client, without the protocol fields (such as __type,
+// or a made up __identity).
+func clientData(auth ClientMessage) ClientMessage {
+	data := make(ClientMessage)
+	for k, v := range auth {
+		if !strings.HasPrefix(k, "__") {
+			data[k] = v
+		}
+	}
+	return data
+}
+
+// Session data: the auth data along with the identity and resume key.
+func sessionData(auth ClientMessage, identity *Identity, resume string) ClientMessage {
+	data := clientData(auth)
+	data[resumeKey] = resume
+	if identity == nil {
+		return data
+	}
+
+	// Store it the way it comes back from the backend
+	var m map[string]interface{}
+	b, err := json.Marshal(identity)
+	if err == nil && json.Unmarshal(b, &m) == nil {
+		data[identityKey] = m
+	}
+	return data
+}
+
+// Removes the identity from session data and returns it.
+func sessionIdentity(auth ClientMessage) *Identity {
+	v, ok := auth[identityKey]
+	if !ok {
+		return nil
+	}
+	delete(auth, identityKey)
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	identity := &Identity{}
+	err = json.Unmarshal(b, identity)
+	if err != nil {
+		return nil
+	}
+	return identity
+}
+
+// Loads the auth data and identity of a session.
+func (s *Server) session(token string) (ClientMessage, *Identity, error) {
+	auth, err := s.Backend.GetSession(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	delete(auth, resumeKey)
+	return auth, sessionIdentity(auth), nil
+}
+
+// Loads the resume key of a session.
+func (s *Server) resumeKey(token string) (string, error) {
+	auth, err := s.Backend.GetSession(token)
+	if err != nil {
+		return "", err
+	}
+	key, _ := auth[resumeKey].(string)
+	return key, nil
+}
+
+// Whether the credentials of a session have expired.
+func (s *Server) sessionExpired(token string) (bool, error) {
+	if s.Authenticator == nil {
+		return false, nil
+	}
+	_, identity, err := s.session(token)
+	if err != nil {
+		return false, err
+	}
+	return identity.Expired(), nil
+}
+
+// Removes a session if its credentials have expired.
+func (s *Server) expireSession(token string) (bool, error) {
+	expired, err := s.sessionExpired(token)
+	if err != nil || !expired {
+		return false, err
+	}
+	return true, s.Backend.DeleteSession(token)
+}
+
+// Adds the expiry of an identity to an authOk or reauthOk reply.
+func withExpiry(m ClientMessage, identity *Identity) ClientMessage {
+	if identity != nil && !identity.Expires.IsZero() {
+		m["expires"] = identity.Expires.UnixNano() / int64(time.Millisecond)
+	}
+	return m
+}
+
+// Whether a client may subscribe to a pattern. Refused unless CanPSubscribe
+// or AuthorizePSubscribe is set.
+func (s *Server) canPSubscribe(identity *Identity, auth ClientMessage, pattern string) bool {
+	if s.CanPSubscribe == nil && s.AuthorizePSubscribe == nil {
+		return false
+	}
+	if len(pattern) > maxPatternLength {
+		return false
+	}
+	if s.AuthorizePSubscribe != nil && !s.AuthorizePSubscribe(identity, pattern) {
+		return false
+	}
+	return s.CanPSubscribe == nil || s.CanPSubscribe(auth, pattern)
+}
+
+// Whether a client may subscribe to a channel.
+func (s *Server) canSubscribe(identity *Identity, auth ClientMessage, channel string) bool {
+	if s.AuthorizeSubscribe != nil && !s.AuthorizeSubscribe(identity, channel) {
+		return false
+	}
+	return s.CanSubscribe == nil || s.CanSubscribe(auth, channel)
+}
+
+// Whether a client may publish a message. Publishing is refused unless
+// CanPublish or AuthorizePublish is set.
+func (s *Server) canPublish(identity *Identity, auth ClientMessage, channel, body string) bool {
+	if s.CanPublish == nil && s.AuthorizePublish == nil {
+		return false
+	}
+	if s.AuthorizePublish != nil && !s.AuthorizePublish(identity, channel, body) {
+		return false
+	}
+	return s.CanPublish == nil || s.CanPublish(auth, channel, body)
+}
+
+// Expires returns when the credentials of the client expire, as reported by
+// the server. Zero when they don't.
+func (c *Client) Expires() time.Time {
+	c.expires_lock.Lock()
+	defer c.expires_lock.Unlock()
+	return c.expires
+}
+
+func (c *Client) setExpires(t time.Time) {
+	c.expires_lock.Lock()
+	defer c.expires_lock.Unlock()
+	c.expires = t
+}
+
+// Reauth sends new credentials, to keep the connection once the current
+// ones expire. They replace AuthData, so reconnecting uses them as well.
+func (c *Client) Reauth(data map[string]interface{}) error {
+	return c.ReauthContext(context.Background(), data)
+}
+
+// ReauthContext is like Reauth, but gives up when the context is done.
+func (c *Client) ReauthContext(ctx context.Context, data map[string]interface{}) error {
+	msg := make(ClientMessage)
+	for k, v := range data {
+		msg[k] = v
+	}
+
+	m, err := c.callContext(ctx, ReauthMessage, msg)
+	if err != nil {
+		return err
+	}
+
+	if m.Type() == ReauthErrorMessage {
+		return fmt.Errorf("Reauth error: %s", m.Reason())
+	} else if m.Type() != ReauthOKMessage {
+		return fmt.Errorf("Expected %s or %s, got %s instead", ReauthOKMessage, ReauthErrorMessage, m.Type())
+	}
+
+	c.AuthData = data
+	c.setExpires(m.Expires())
+	return nil
+}
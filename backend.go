@@ -0,0 +1,138 @@
+package broadcaster
+
+import "time"
+
+// A Backend stores session data and relays pub/sub messages between the
+// nodes of a broadcaster cluster.
+//
+// The default backend is backed by Redis, see the Redis fields of Server.
+type Backend interface {
+	// Messages received on subscribed channels and on the control channel.
+	Messages() <-chan BackendMessage
+
+	// Starts receiving messages for the given channel.
+	Subscribe(channel string)
+
+	// Stops receiving messages for the given channel.
+	Unsubscribe(channel string)
+
+	// Starts receiving messages for all channels matching a glob pattern.
+	PSubscribe(pattern string)
+
+	// Stops receiving messages for the given pattern.
+	PUnsubscribe(pattern string)
+
+	// Publishes a message to all nodes.
+	Publish(m Message) error
+
+	// Generates a new message id for the given channel. Message ids are
+	// increasing numbers, the sequence starts over once the channel has
+	// been idle for the ttl duration.
+	NextID(channel string, ttl time.Duration) (string, error)
+
+	// Adds a message to the history of a channel, keeping at most length
+	// messages for the ttl duration.
+	StoreHistory(channel string, m Message, length int, ttl time.Duration) error
+
+	// Stored history of a channel, oldest message first
+	GetHistory(channel string) ([]Message, error)
+
+	// Sends a message to all subscribers of a channel, on all nodes.
+	Notify(channel string, m ClientMessage) error
+
+	// Presence storage, entries expire after the ttl unless refreshed
+	AddPresence(channel string, p PresenceEntry, ttl time.Duration) error
+	RemovePresence(channel, id string) error
+	RefreshPresence(channel string, ids []string, ttl time.Duration) error
+	GetPresence(channel string) ([]PresenceEntry, error)
+
+	// Storage for messages that weren't acknowledged yet, see
+	// Server.RequireAck. Stored per pending key of a connection, adding a
+	// message again replaces it.
+	AddPending(key string, messages []PendingMessage, ttl time.Duration) error
+	RemovePending(key, channel, id string) error
+	GetPending(keys []string) (map[string][]PendingMessage, error)
+
+	// Stores the stats of a node, until they expire after ttl
+	StoreNodeStats(stats NodeStats, ttl time.Duration) error
+
+	// Stats of all nodes that haven't expired yet
+	GetNodeStats() ([]NodeStats, error)
+
+	// Whether the backend is ready to receive messages.
+	IsListening() bool
+
+	// Stops listening and closes all connections.
+	Close() error
+
+	// Number of connected clients.
+	GetConnected() (int, error)
+
+	// Session storage
+	StoreSession(token string, auth ClientMessage) error
+	DeleteSession(token string) error
+
+	// Replaces the auth data of an existing session
+	UpdateSession(token string, auth ClientMessage) error
+	GetSession(token string) (ClientMessage, error)
+	IsConnected(token string) (bool, error)
+
+	// Records channel subscription and broadcasts it to listeners
+	LongpollSubscribe(token, channel string) error
+
+	// Records channel unsubscription and broadcasts it to listeners
+	LongpollUnsubscribe(token, channel string) error
+
+	// Channels a long-polling connection is subscribed to
+	LongpollGetChannels(token string) ([]string, error)
+
+	// Records pattern subscription and broadcasts it to listeners
+	LongpollPSubscribe(token, pattern string) error
+
+	// Records pattern unsubscription and broadcasts it to listeners
+	LongpollPUnsubscribe(token, pattern string) error
+
+	// Patterns a long-polling connection is subscribed to
+	LongpollGetPatterns(token string) ([]string, error)
+
+	// Keeps the session of a long-polling connection alive
+	LongpollPing(token string) error
+
+	// Stores a message for delivery on the next poll
+	LongpollBacklog(token string, m ClientMessage) error
+
+	// Tells other listeners for the token to stop
+	LongpollTransfer(token, seq string) error
+
+	// Sends all stored messages on the result channel
+	LongpollGetBacklog(token string, result chan ClientMessage)
+
+	// Sets fields of the resume cursor of an event stream, clears the
+	// other fields first when reset is set
+	LongpollStoreCursor(token string, fields map[string]string, reset bool) error
+
+	// Fields of the resume cursor of an event stream
+	LongpollGetCursor(token string) (map[string]string, error)
+}
+
+// A BackendMessage is a message received by a Backend.
+type BackendMessage struct {
+	// Channel on which the message was received
+	Channel string
+
+	// Matched pattern, for pattern subscriptions
+	Pattern string
+
+	// Message body
+	Data []byte
+
+	// Set for internal coordination messages
+	Control bool
+
+	// Message id, empty for messages that were not published through a
+	// Server
+	ID string
+
+	// Time at which the message was published
+	Time time.Time
+}
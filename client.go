@@ -1,15 +1,19 @@
 package broadcaster
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
 	"go.uber.org/atomic"
 )
 
+var errReconnect = errors.New("Reconnect requested by server")
+
 type CloseError struct {
 	Code int
 	Text string
@@ -27,6 +31,7 @@ const (
 	ClientModeAuto      ClientMode = 0
 	ClientModeWebsocket ClientMode = 1
 	ClientModeLongPoll  ClientMode = 2
+	ClientModeSSE       ClientMode = 3
 )
 
 type messageChan chan ClientMessage
@@ -43,7 +48,7 @@ type Client struct {
 	// Incoming messages
 	Messages chan ClientMessage
 
-	// Receives true when disconnected
+	// Receives true when giving up on reconnecting, see ReconnectPolicy
 	Disconnected chan bool
 
 	// Timeout
@@ -52,12 +57,40 @@ type Client struct {
 	// Ping interval
 	PingInterval time.Duration
 
-	// Reconnection attempts
+	// Reconnection attempts, used when Reconnect is not set
 	MaxAttempts int
 
+	// How to reconnect after losing the connection
+	Reconnect *ReconnectPolicy
+
+	// Called when the connection state changes, see State()
+	OnStateChange func(state ClientState)
+
 	// Can be overwritten
 	UserAgent string
 
+	// Negotiates permessage-deflate compression for websocket connections,
+	// see Server.EnableCompression. Long-poll replies are decompressed
+	// automatically.
+	EnableCompression bool
+
+	// Wire format to use instead of JSON, such as MessagePack. Falls back
+	// to JSON when the server doesn't support it.
+	Codec Codec
+
+	// Messages that need to be acknowledged (see Server.RequireAck) are
+	// acked once they're passed to Messages, unless this is set. Use Ack()
+	// to do so manually.
+	ManualAck bool
+
+	// Number of messages queued for each SubscribeFunc handler, defaults
+	// to 100
+	HandlerQueueSize int
+
+	// What happens when a handler queue is full. OverflowDisconnect
+	// unsubscribes from the channel. Defaults to OverflowDropOldest
+	HandlerOverflowPolicy OverflowPolicy
+
 	// Connection params
 	host   string
 	path   string
@@ -66,16 +99,44 @@ type Client struct {
 	// Only used while testing
 	skip_auth bool
 
+	// Session token
+	token      string
+	token_lock sync.Mutex
+
+	// Passed when resubscribing to get unacked messages
+	resume string
+
 	// Internal bits
 	transport         clientTransport
+	transport_lock    sync.Mutex
+	reconnect_lock    sync.Mutex
 	results           map[string]messageChan
 	results_lock      sync.Mutex
 	should_disconnect *atomic.Bool
-	attempts          int
+	quit              chan struct{}
+	requests          *atomic.Int64
+	state             ClientState
+	state_changes     []ClientState
+	state_notifying   bool
+	state_lock        sync.Mutex
+	expires           time.Time
+	expires_lock      sync.Mutex
 
 	channels      map[string]bool
+	patterns      map[string]bool
+	signatures    map[string]ClientMessage
 	channels_lock sync.Mutex
 
+	// Handlers registered with SubscribeFunc
+	handlers      map[string]*dispatcher
+	handlers_lock sync.Mutex
+
+	// Last seen message id per channel, and the replay progress of
+	// channels that are still catching up
+	last_ids      map[string]string
+	replaying     map[string]*replayState
+	last_ids_lock sync.Mutex
+
 	disconnect_lock sync.Mutex
 	disconnect_done bool
 }
@@ -93,18 +154,26 @@ func NewClient(urlStr string) (*Client, error) {
 		Timeout:           30 * time.Second,
 		PingInterval:      30 * time.Second,
 		MaxAttempts:       10,
+		HandlerQueueSize:  100,
 		channels:          make(map[string]bool),
+		patterns:          make(map[string]bool),
+		signatures:        make(map[string]ClientMessage),
+		last_ids:          make(map[string]string),
+		replaying:         make(map[string]*replayState),
+		handlers:          make(map[string]*dispatcher),
 		results:           make(map[string]messageChan),
 		Messages:          make(messageChan, 10),
 		Disconnected:      make(chan bool),
+		quit:              make(chan struct{}),
 		should_disconnect: atomic.NewBool(false),
+		requests:          atomic.NewInt64(0),
 	}, nil
 }
 
 func (c *Client) url(mode ClientMode) string {
 	scheme := "ws"
 
-	if mode == ClientModeLongPoll {
+	if mode == ClientModeLongPoll || mode == ClientModeSSE {
 		scheme = "http"
 	}
 
@@ -116,65 +185,145 @@ func (c *Client) url(mode ClientMode) string {
 }
 
 func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect, but gives up once the context is done.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	c.setState(ClientStateConnecting)
+	results, err := c.connect(ctx)
+	if err != nil {
+		c.setState(ClientStateDisconnected)
+		return err
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			return r.Err
+		}
+	}
+	return nil
+}
+
+// Connects and restores the subscriptions, returns the per-channel results.
+func (c *Client) connect(ctx context.Context) ([]ResubscribeResult, error) {
 	c.should_disconnect.Store(false)
+	previous := c.resume
 
-	if c.Mode == ClientModeAuto || c.Mode == ClientModeWebsocket {
-		c.transport = newWebsocketClientTransport(c)
-		err := c.transport.Connect(c.AuthData)
-		if err != nil {
-			if c.Mode == ClientModeAuto {
-				c.transport = newlongpollClientTransport(c)
-				err := c.transport.Connect(c.AuthData)
-				if err != nil {
-					return err
-				}
-			} else {
-				return err
-			}
+	transport, err := c.connectTransport(ctx)
+	if err != nil {
+		if transport != nil {
+			transport.Close()
 		}
-	} else if c.Mode == ClientModeLongPoll {
-		c.transport = newlongpollClientTransport(c)
-		err := c.transport.Connect(c.AuthData)
-		if err != nil {
-			return err
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-	} else {
-		return fmt.Errorf("Unknown client mode: %d", c.Mode)
+		return nil, err
 	}
 
 	if !c.skip_auth {
-		m, err := c.transport.Receive()
+		m, err := c.receiveContext(ctx, transport)
 		if err != nil {
-			return err
+			transport.Close()
+			return nil, err
 		}
 
-		if m.Type() == AuthFailedMessage {
-			return &CloseError{
-				Code: 4401,
-				Text: m.Reason(),
-			}
-		} else if m.Type() != AuthOKMessage {
-			return fmt.Errorf("Expected %s or %s, got %s instead", AuthOKMessage, AuthFailedMessage, m.Type())
+		// Transports turn authFailed into a CloseError
+		if m.Type() != AuthOKMessage {
+			transport.Close()
+			return nil, fmt.Errorf("Expected %s or %s, got %s instead", AuthOKMessage, AuthFailedMessage, m.Type())
 		}
+		c.setToken(m.Token())
+		c.resume = m.ResumeKey()
+		c.setExpires(m.Expires())
 	}
 
-	go c.listen()
+	c.setTransport(transport)
+	if c.skip_auth {
+		// Tests read messages themselves
+		return nil, nil
+	}
+	transport.onConnect()
+	go c.listen(transport)
 
-	c.channels_lock.Lock()
-	toSubscribe := make([]string, 0)
-	for channel, _ := range c.channels {
-		toSubscribe = append(toSubscribe, channel)
+	results, err := c.resubscribe(ctx, previous)
+	if err != nil {
+		// Don't leave a half-connected transport around
+		c.setTransport(nil)
+		transport.Close()
+		return nil, err
 	}
-	c.channels_lock.Unlock()
+	c.setState(ClientStateConnected)
+	return results, nil
+}
 
-	for _, channel := range toSubscribe {
-		err := c.Subscribe(channel)
+func (c *Client) connectTransport(ctx context.Context) (clientTransport, error) {
+	var transport clientTransport
+	if c.Mode == ClientModeAuto || c.Mode == ClientModeWebsocket {
+		transport = newWebsocketClientTransport(c)
+		err := transport.Connect(ctx, c.AuthData)
 		if err != nil {
-			return err
+			if c.Mode == ClientModeAuto && ctx.Err() == nil {
+				transport = newlongpollClientTransport(c)
+				return transport, transport.Connect(ctx, c.AuthData)
+			}
+			return nil, err
 		}
+		return transport, nil
+	} else if c.Mode == ClientModeLongPoll {
+		transport = newlongpollClientTransport(c)
+		return transport, transport.Connect(ctx, c.AuthData)
+	} else if c.Mode == ClientModeSSE {
+		transport = newSSEClientTransport(c)
+		return transport, transport.Connect(ctx, c.AuthData)
 	}
+	return nil, fmt.Errorf("Unknown client mode: %d", c.Mode)
+}
 
-	return nil
+func (c *Client) getTransport() clientTransport {
+	c.transport_lock.Lock()
+	defer c.transport_lock.Unlock()
+	return c.transport
+}
+
+func (c *Client) setTransport(t clientTransport) {
+	c.transport_lock.Lock()
+	defer c.transport_lock.Unlock()
+	c.transport = t
+}
+
+// Token returns the session token. Changes when reconnecting.
+func (c *Client) Token() string {
+	c.token_lock.Lock()
+	defer c.token_lock.Unlock()
+	return c.token
+}
+
+func (c *Client) setToken(token string) {
+	c.token_lock.Lock()
+	defer c.token_lock.Unlock()
+	c.token = token
+}
+
+// Receives a message, closes the transport when the context is done.
+func (c *Client) receiveContext(ctx context.Context, transport clientTransport) (ClientMessage, error) {
+	type result struct {
+		m   ClientMessage
+		err error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		m, err := transport.Receive()
+		done <- result{m, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.m, r.err
+	case <-ctx.Done():
+		transport.Close()
+		return nil, ctx.Err()
+	}
 }
 
 func (c *Client) Disconnect() error {
@@ -187,9 +336,13 @@ func (c *Client) Disconnect() error {
 		return nil
 	}
 
-	err := c.transport.Close()
-	if err != nil && c.Error == nil {
-		c.Error = err
+	close(c.quit)
+	c.setState(ClientStateClosed)
+	if transport := c.getTransport(); transport != nil {
+		err := transport.Close()
+		if err != nil && c.Error == nil {
+			c.Error = err
+		}
 	}
 	c.results_lock.Lock()
 	for _, r := range c.results {
@@ -197,48 +350,39 @@ func (c *Client) Disconnect() error {
 	}
 	c.results_lock.Unlock()
 
+	c.handlers_lock.Lock()
+	for _, d := range c.handlers {
+		d.stop()
+	}
+	c.handlers = make(map[string]*dispatcher)
+	c.handlers_lock.Unlock()
+
 	close(c.Messages)
 	c.disconnect_done = true
 
 	return c.Error
 }
 
-func (c *Client) disconnected() {
-	should_disconnect := c.should_disconnect.Load()
-	if should_disconnect {
-		return
-	}
-
-	if c.attempts == c.MaxAttempts {
-		c.Error = errors.New("Disconnected")
-		c.Disconnected <- true
-	}
-
-	c.attempts++
-	err := c.Connect()
-	if err == nil {
-		// Connected!
-		return
-	}
-
-	// Back off
-	<-time.After(time.Duration(c.attempts-1) * time.Second)
-	c.disconnected()
-}
-
-func (c *Client) listen() {
-	c.transport.onConnect()
-
+func (c *Client) listen(transport clientTransport) {
 	for {
-		m, err := c.receive()
+		m, err := transport.Receive()
 		if err != nil {
-			c.disconnected()
+			c.disconnected(transport)
 			return
 		}
 
-		if m.Type() == MessageMessage {
+		if m.Type() == MessageMessage && c.replayed(m) {
+			// Live copy of a replayed message
+		} else if m.Type() == MessageMessage && c.dispatch(m) {
+			// Handled by SubscribeFunc
+		} else if m.Type() == MessageMessage || m.Type() == JoinMessage || m.Type() == LeaveMessage {
 			c.relay(m)
+			if !c.ManualAck {
+				c.Ack(m)
+			}
 		} else {
+			c.startReplay(m)
+
 			c.results_lock.Lock()
 			channel, ok := c.results[m.ResultId()]
 			c.results_lock.Unlock()
@@ -257,24 +401,113 @@ func (c *Client) relay(m ClientMessage) {
 	defer c.disconnect_lock.Unlock()
 
 	if !c.disconnect_done {
+		c.setLastID(m)
 		c.Messages <- m
 	}
 }
 
+func (c *Client) setLastID(m ClientMessage) {
+	// Pattern messages don't count, resuming a channel subscription
+	// should not skip over them.
+	if id := m.ID(); id != "" && m.Pattern() == "" {
+		c.last_ids_lock.Lock()
+		c.last_ids[m.Channel()] = id
+		c.last_ids_lock.Unlock()
+	}
+}
+
+// Notes the last replayed id of the channels in a subscribe result.
+func (c *Client) startReplay(m ClientMessage) {
+	results := []ClientMessage{m}
+	if m.Type() == SubscribeManyResultMessage {
+		results = m.Results()
+	}
+
+	c.last_ids_lock.Lock()
+	defer c.last_ids_lock.Unlock()
+	for _, r := range results {
+		if id := r.ID(); r.Type() == SubscribeOKMessage && id != "" {
+			c.replaying[r.Channel()] = &replayState{until: id}
+		}
+	}
+}
+
+// Ids of a replay: the last replayed one and the last one received.
+type replayState struct {
+	until string
+	last  string
+}
+
+// Whether a message was already received as part of a replay. Replayed
+// messages come first, so anything up to the last received id is a
+// duplicate until the replay has been caught up with.
+func (c *Client) replayed(m ClientMessage) bool {
+	id := m.ID()
+	if id == "" || m.Pattern() != "" {
+		return false
+	}
+
+	c.last_ids_lock.Lock()
+	defer c.last_ids_lock.Unlock()
+	channel := m.Channel()
+	r, ok := c.replaying[channel]
+	if !ok {
+		return false
+	}
+	if idAfter(id, r.until) {
+		delete(c.replaying, channel)
+		return false
+	}
+	if r.last != "" && !idAfter(id, r.last) {
+		return true
+	}
+	r.last = id
+	return false
+}
+
+// Ack acknowledges a message, for channels that require it. It does nothing
+// for other messages. Over long-polling and SSE the ack is posted in the
+// background.
+func (c *Client) Ack(m ClientMessage) error {
+	if !m.NeedsAck() {
+		return nil
+	}
+	return c.send(AckMessage, ClientMessage{"channel": m.Channel(), "id": m.ID()})
+}
+
+// LastID returns the id of the last message received on the given channel,
+// or an empty string if there is none.
+func (c *Client) LastID(channel string) string {
+	c.last_ids_lock.Lock()
+	defer c.last_ids_lock.Unlock()
+	return c.last_ids[channel]
+}
+
 func (c *Client) send(msg string, data ClientMessage) error {
+	if data == nil {
+		data = make(ClientMessage)
+	}
+	return c.sendContext(context.Background(), msg, data)
+}
+
+func (c *Client) sendContext(ctx context.Context, msg string, data ClientMessage) error {
 	if data == nil {
 		data = make(ClientMessage)
 	}
 	data["__type"] = msg
-	return c.transport.Send(data)
+
+	transport := c.getTransport()
+	if transport == nil {
+		return errors.New("Not connected")
+	}
+	return transport.Send(ctx, data)
 }
 
 func (c *Client) receive() (ClientMessage, error) {
-	return c.transport.Receive()
+	return c.getTransport().Receive()
 }
 
-func (c *Client) resultChan(format string, args ...interface{}) chan ClientMessage {
-	name := fmt.Sprintf(format, args...)
+func (c *Client) resultChan(name string) chan ClientMessage {
 	channel := make(chan ClientMessage, 1)
 	c.results_lock.Lock()
 	c.results[name] = channel
@@ -282,23 +515,67 @@ func (c *Client) resultChan(format string, args ...interface{}) chan ClientMessa
 	return channel
 }
 
+// Removes a result channel, unless it has been replaced already.
+func (c *Client) removeResult(name string, channel chan ClientMessage) {
+	c.results_lock.Lock()
+	defer c.results_lock.Unlock()
+	if c.results[name] == channel {
+		delete(c.results, name)
+	}
+}
+
 func (c *Client) call(msgType string, msg ClientMessage) (ClientMessage, error) {
-	result := c.resultChan("%s_%s", msgType, msg["channel"])
+	return c.callContext(context.Background(), msgType, msg)
+}
+
+// Sends a request and waits for its result, gives up after Timeout or when
+// the context is done.
+func (c *Client) callContext(ctx context.Context, msgType string, msg ClientMessage) (ClientMessage, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
 
-	err := c.send(msgType, msg)
+	// The server echoes the id in its reply
+	name := strconv.FormatInt(c.requests.Inc(), 10)
+	msg["__id"] = name
+	result := c.resultChan(name)
+
+	err := c.sendContext(ctx, msgType, msg)
 	if err != nil {
+		c.removeResult(name, result)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
-	m, ok := <-result
-	if !ok {
-		return nil, c.Error
+	select {
+	case m, ok := <-result:
+		if !ok {
+			return nil, c.Error
+		}
+		c.removeResult(name, result)
+		return m, nil
+	case <-ctx.Done():
+		c.removeResult(name, result)
+		return nil, ctx.Err()
 	}
-	return m, nil
 }
 
-func (c *Client) Subscribe(channel string) error {
-	m, err := c.call(SubscribeMessage, ClientMessage{"channel": channel})
+func (c *Client) Subscribe(channel string, opts ...SubscribeOption) error {
+	return c.SubscribeContext(context.Background(), channel, opts...)
+}
+
+// SubscribeContext is like Subscribe, but gives up once the context is done.
+func (c *Client) SubscribeContext(ctx context.Context, channel string, opts ...SubscribeOption) error {
+	msg := ClientMessage{"channel": channel}
+	for _, opt := range opts {
+		opt(msg)
+	}
+
+	m, err := c.callContext(ctx, SubscribeMessage, msg)
 	if err != nil {
 		return err
 	}
@@ -315,12 +592,19 @@ func (c *Client) Subscribe(channel string) error {
 
 	c.channels_lock.Lock()
 	c.channels[channel] = true
+	c.keepSignature(channel, msg)
 	c.channels_lock.Unlock()
 	return nil
 }
 
 func (c *Client) Unsubscribe(channel string) error {
-	m, err := c.call(UnsubscribeMessage, ClientMessage{"channel": channel})
+	return c.UnsubscribeContext(context.Background(), channel)
+}
+
+// UnsubscribeContext is like Unsubscribe, but gives up once the context is
+// done.
+func (c *Client) UnsubscribeContext(ctx context.Context, channel string) error {
+	m, err := c.callContext(ctx, UnsubscribeMessage, ClientMessage{"channel": channel})
 	if err != nil {
 		return err
 	}
@@ -334,15 +618,202 @@ func (c *Client) Unsubscribe(channel string) error {
 
 	c.channels_lock.Lock()
 	c.channels[channel] = false
+	delete(c.signatures, channel)
 	c.channels_lock.Unlock()
+
+	c.last_ids_lock.Lock()
+	delete(c.last_ids, channel)
+	delete(c.replaying, channel)
+	c.last_ids_lock.Unlock()
+
+	c.removeHandler(channel)
+	return nil
+}
+
+// SubscribeMany subscribes to multiple channels in a single round trip (one
+// per MaxBatchSize channels). The options are applied to each channel.
+//
+// The returned map holds an error for each channel that could not be
+// subscribed to, other channels are subscribed even if some fail.
+func (c *Client) SubscribeMany(channels []string, opts ...SubscribeOption) (map[string]error, error) {
+	entries := make([]ClientMessage, 0, len(channels))
+	for _, channel := range channels {
+		entry := ClientMessage{"channel": channel}
+		for _, opt := range opts {
+			opt(entry)
+		}
+		entries = append(entries, entry)
+	}
+	return c.subscribeMany(context.Background(), entries)
+}
+
+func (c *Client) subscribeMany(ctx context.Context, entries []ClientMessage) (map[string]error, error) {
+	results, err := c.callMany(ctx, SubscribeManyMessage, SubscribeManyResultMessage, entries)
+
+	// Keep track of the batches that did go through
+	failed := make(map[string]error)
+	c.channels_lock.Lock()
+	defer c.channels_lock.Unlock()
+	for _, r := range results {
+		channel := r.Channel()
+		if r.Type() == SubscribeOKMessage {
+			c.channels[channel] = true
+		} else {
+			failed[channel] = fmt.Errorf("Subscribe error: %s", r.Reason())
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// UnsubscribeMany unsubscribes from multiple channels in a single round trip.
+// The returned map holds an error for each channel that failed.
+func (c *Client) UnsubscribeMany(channels []string) (map[string]error, error) {
+	entries := make([]ClientMessage, 0, len(channels))
+	for _, channel := range channels {
+		entries = append(entries, ClientMessage{"channel": channel})
+	}
+
+	results, err := c.callMany(context.Background(), UnsubscribeManyMessage, UnsubscribeManyResultMessage, entries)
+
+	failed := make(map[string]error)
+	for _, r := range results {
+		channel := r.Channel()
+		if r.Type() != UnsubscribeOKMessage {
+			failed[channel] = fmt.Errorf("Unsubscribe error: %s", r.Reason())
+			continue
+		}
+
+		c.channels_lock.Lock()
+		c.channels[channel] = false
+		delete(c.signatures, channel)
+		c.channels_lock.Unlock()
+
+		c.last_ids_lock.Lock()
+		delete(c.last_ids, channel)
+		delete(c.replaying, channel)
+		c.last_ids_lock.Unlock()
+
+		c.removeHandler(channel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return failed, nil
+}
+
+// Sends batch requests of at most MaxBatchSize entries, returns the
+// per-channel results. On errors, results hold those of the batches that
+// went through.
+func (c *Client) callMany(ctx context.Context, msgType, resultType string, entries []ClientMessage) ([]ClientMessage, error) {
+	results := make([]ClientMessage, 0, len(entries))
+	for len(entries) > 0 {
+		chunk := entries
+		if len(chunk) > MaxBatchSize {
+			chunk = chunk[:MaxBatchSize]
+		}
+		entries = entries[len(chunk):]
+
+		m, err := c.callContext(ctx, msgType, ClientMessage{"channels": chunk})
+		if err != nil {
+			return results, err
+		}
+
+		if m.Type() != resultType {
+			return results, fmt.Errorf("Expected %s, got %s instead", resultType, m.Type())
+		}
+
+		r := m.Results()
+		if len(r) != len(chunk) {
+			return results, fmt.Errorf("Expected %d results, got %d instead", len(chunk), len(r))
+		}
+		results = append(results, r...)
+	}
+	return results, nil
+}
+
+// PSubscribe subscribes to all channels matching a glob-style pattern, such
+// as "news.*". Received messages have both the channel and the pattern set.
+//
+// Needs CanPSubscribe or AuthorizePSubscribe on the server, which are called
+// with the pattern, not with the matched channels.
+// Pattern subscriptions do not track presence or replay history.
+func (c *Client) PSubscribe(pattern string) error {
+	return c.psubscribe(context.Background(), pattern)
+}
+
+func (c *Client) psubscribe(ctx context.Context, pattern string) error {
+	m, err := c.callContext(ctx, PSubscribeMessage, ClientMessage{"channel": pattern})
+	if err != nil {
+		return err
+	}
+	return c.psubscribeResult(pattern, m)
+}
+
+func (c *Client) psubscribeResult(pattern string, m ClientMessage) error {
+	if m.Type() == PSubscribeErrorMessage {
+		return fmt.Errorf("Subscribe error: %s", m["reason"])
+	} else if m.Type() != PSubscribeOKMessage {
+		return fmt.Errorf("Expected %s or %s, got %s instead", PSubscribeOKMessage, PSubscribeErrorMessage, m.Type())
+	}
+
+	if m["channel"] != pattern {
+		return fmt.Errorf("Expected pattern %s, got %s instead", pattern, m["channel"])
+	}
+
+	c.channels_lock.Lock()
+	c.patterns[pattern] = true
+	c.channels_lock.Unlock()
+	return nil
+}
+
+func (c *Client) PUnsubscribe(pattern string) error {
+	m, err := c.call(PUnsubscribeMessage, ClientMessage{"channel": pattern})
+	if err != nil {
+		return err
+	}
+
+	if m.Type() != PUnsubscribeOKMessage {
+		return fmt.Errorf("Expected %s, got %s instead", PUnsubscribeOKMessage, m.Type())
+	}
+	if m["channel"] != pattern {
+		return fmt.Errorf("Expected pattern %s, got %s instead", pattern, m["channel"])
+	}
+
+	c.channels_lock.Lock()
+	c.patterns[pattern] = false
+	c.channels_lock.Unlock()
+	return nil
+}
+
+func (c *Client) Publish(channel, body string) error {
+	m, err := c.call(PublishMessage, ClientMessage{"channel": channel, "body": body})
+	if err != nil {
+		return err
+	}
+
+	if m.Type() == PublishErrorMessage {
+		return fmt.Errorf("Publish error: %s", m["reason"])
+	} else if m.Type() != PublishOKMessage {
+		return fmt.Errorf("Expected %s or %s, got %s instead", PublishOKMessage, PublishErrorMessage, m.Type())
+	}
+
+	if m["channel"] != channel {
+		return fmt.Errorf("Expected channel %s, got %s instead", channel, m["channel"])
+	}
 	return nil
 }
 
 type clientTransport interface {
-	Connect(authData ClientMessage) error
+	Connect(ctx context.Context, authData ClientMessage) error
 	Close() error
-	Send(data ClientMessage) error
+	Send(ctx context.Context, data ClientMessage) error
 	Receive() (ClientMessage, error)
 
 	onConnect()
+
+	// Connection mode implemented by this transport
+	mode() ClientMode
 }
@@ -1,11 +1,21 @@
 package broadcaster
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
 	_ "net/http/pprof"
+
+	"go.uber.org/atomic"
 )
 
 func init() {
@@ -29,7 +39,7 @@ func testCanConnect(t *testing.T, clientFn func(s *testServer, conf ...func(c *C
 	client, err := clientFn(server)
 	var cErr *CloseError
 	if err == nil || !errors.As(err, &cErr) || cErr.Code != 4401 || cErr.Text != "Unauthorized" {
-		t.Fatal("Did not properly deny access")
+		t.Fatalf("Did not properly deny access %v", err)
 	}
 	if client != nil {
 		t.Fatal("Did not expect client")
@@ -204,7 +214,7 @@ func testRefusesUnauthedCommands(t *testing.T, clientFn func(s *testServer, conf
 	_, err = client.receive()
 	var cErr *CloseError
 	if err == nil || !errors.As(err, &cErr) || cErr.Code != 4401 || cErr.Text != "Auth expected" {
-		t.Fatal("Did not properly deny access")
+		t.Fatalf("Did not properly deny access %v", err)
 	}
 
 	stats, err := server.Broadcaster.Stats()
@@ -238,7 +248,7 @@ func testCanSubscribe(t *testing.T, clientFn func(s *testServer, conf ...func(c
 		t.Fatal("Expected error!")
 	}
 	if err.Error() != "Subscribe error: Channel refused" {
-		t.Fatal("Did not properly deny access")
+		t.Fatalf("Did not properly deny access %v", err)
 	}
 
 	stats, err := server.Broadcaster.Stats()
@@ -249,3 +259,1879 @@ func testCanSubscribe(t *testing.T, clientFn func(s *testServer, conf ...func(c
 		t.Errorf("Unexpected subscription count: %d", stats.LocalSubscriptions["test"])
 	}
 }
+
+func testServerPublish(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Broadcaster.PublishJSON("test", map[string]int{"count": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Error("Wrong message payload")
+	}
+
+	m = <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != `{"count":1}` {
+		t.Error("Wrong message payload")
+	}
+}
+
+func testClientPublish(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel, body string) bool {
+			return channel == "test"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = client.Publish("other", "Other message")
+	if err == nil {
+		t.Fatal("Expected error!")
+	}
+	if err.Error() != "Publish error: Publish refused" {
+		t.Fatalf("Did not properly deny access %v", err)
+	}
+
+	err = client.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "Test message" {
+		t.Error("Wrong message payload")
+	}
+}
+
+func testHistory(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		HistoryLength: 2,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	start := time.Now()
+	for _, msg := range []string{"1", "2", "3"} {
+		err = server.Broadcaster.Publish("test", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Only the last two messages are kept
+	err = client.Subscribe("test", SubscribeSinceTime(start.Add(-time.Second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "2" || m["id"] != "2" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	m = <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "3" || m["id"] != "3" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	err = client.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Subscribe("test", SubscribeSince("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = <-client.Messages
+	if m.Type() != "message" || m["channel"] != "test" || m["body"] != "3" || m["id"] != "3" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	err = client.Subscribe("other", SubscribeSince("bla"))
+	if err == nil || err.Error() != "Subscribe error: Invalid message id" {
+		t.Errorf("Expected error, got %v", err)
+	}
+}
+
+func testMessageIDs(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	start := time.Now().Add(-time.Second)
+	for _, msg := range []string{"1", "2"} {
+		err = server.Broadcaster.Publish("test", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, id := range []string{"1", "2"} {
+		m := <-client.Messages
+		if m.Type() != "message" || m.ID() != id || m.Body() != id {
+			t.Errorf("Wrong message payload: %#v", m)
+		}
+		if m.Time().Before(start) {
+			t.Errorf("Wrong message time: %s", m.Time())
+		}
+	}
+
+	if client.LastID("test") != "2" {
+		t.Errorf("Unexpected last id: %s", client.LastID("test"))
+	}
+}
+
+func testPresence(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		TrackPresence: func(channel string) bool {
+			return channel == "test"
+		},
+		PresenceFields: []string{"name"},
+		PresenceEvents: true,
+		StatsInterval:  100 * time.Millisecond,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client1, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"name": "a", "secret": "abc"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client1.Disconnect()
+
+	err = client1.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	presence, err := server.Broadcaster.Presence("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != 1 || presence[0].Data["name"] != "a" || presence[0].Data["secret"] != nil {
+		t.Errorf("Unexpected presence: %#v", presence)
+	}
+
+	// Wait until polling socket is connected, so we get the events
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	// Skips our own join event, if received
+	next := func() ClientMessage {
+		for {
+			m := <-client1.Messages
+			data, _ := m["data"].(map[string]interface{})
+			if m.Type() != JoinMessage || data["name"] != "a" {
+				return m
+			}
+		}
+	}
+
+	client2, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"name": "b"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client2.Disconnect()
+
+	err = client2.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := next()
+	data, _ := m["data"].(map[string]interface{})
+	if m.Type() != JoinMessage || m.Channel() != "test" || data["name"] != "b" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+	if _, ok := m["token"]; ok {
+		t.Errorf("Session token shared: %#v", m)
+	}
+	member, _ := m["member"].(string)
+	if member == "" || member == client2.Token() {
+		t.Errorf("Unexpected member id: %#v", member)
+	}
+
+	presence, err = server.Broadcaster.Presence("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != 2 {
+		t.Errorf("Unexpected presence: %#v", presence)
+	}
+
+	err = client2.Unsubscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = next()
+	if m.Type() != LeaveMessage || m.Channel() != "test" || m["member"] != member {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	// Heartbeats keep the entries of live connections
+	time.Sleep(500 * time.Millisecond)
+	presence, err = server.Broadcaster.Presence("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != 1 || presence[0].Data["name"] != "a" {
+		t.Errorf("Unexpected presence: %#v", presence)
+	}
+}
+
+func testClusterStats(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		NodeID:        "node1",
+		StatsInterval: 100 * time.Millisecond,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-client.Messages
+
+	// Wait for heartbeat
+	<-time.After(200 * time.Millisecond)
+
+	stats, err := server.Broadcaster.ClusterStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Nodes) != 1 || stats.Nodes[0].NodeID != "node1" {
+		t.Errorf("Unexpected nodes: %#v", stats.Nodes)
+	}
+	connections := 0
+	for _, v := range stats.Connections {
+		connections += v
+	}
+	if connections != 1 {
+		t.Errorf("Unexpected connection count: %#v", stats.Connections)
+	}
+	if stats.Subscriptions["test"] != 1 {
+		t.Errorf("Unexpected subscription count: %d", stats.Subscriptions["test"])
+	}
+	if stats.MessagesRelayed != 1 {
+		t.Errorf("Unexpected relayed count: %d", stats.MessagesRelayed)
+	}
+}
+
+func testMetrics(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel == "test"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("other")
+	if err == nil {
+		t.Fatal("Expected error!")
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	w := httptest.NewRecorder()
+	server.Broadcaster.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", w.Code)
+	}
+
+	body := w.Body.String()
+	expected := []string{
+		"# TYPE broadcaster_connections gauge\n",
+		"broadcaster_subscribes_total 1\n",
+		"broadcaster_auth_failures_total{type=\"subscribe\"} 1\n",
+		"broadcaster_channels 1\n",
+		"broadcaster_connections{transport=\"sse\"} ",
+		"# TYPE broadcaster_longpoll_backlog_size gauge\n",
+	}
+	for _, e := range expected {
+		if !strings.Contains(body, e) {
+			t.Errorf("Expected %q in metrics:\n%s", e, body)
+		}
+	}
+}
+
+func testShutdown(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = server.Broadcaster.Shutdown(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := server.Broadcaster.hub.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Connections) != 0 || len(stats.LocalSubscriptions) != 0 {
+		t.Errorf("Unexpected stats after shutdown: %#v", stats)
+	}
+
+	// New connections are refused
+	w := httptest.NewRecorder()
+	server.Broadcaster.ServeHTTP(w, httptest.NewRequest("POST", "/broadcaster/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Unexpected status code: %d", w.Code)
+	}
+
+	// Even when they got past the first check
+	err = server.Broadcaster.register(&testConnection{})
+	if err == nil {
+		t.Error("Expected registration to be refused")
+	}
+}
+
+func testPatternSubscribe(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel != "secret"
+		},
+		CanPSubscribe: func(data map[string]interface{}, pattern string) bool {
+			return pattern == "news.*"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.PSubscribe("other.*")
+	if err == nil || err.Error() != "Subscribe error: Channel refused" {
+		t.Fatalf("Did not properly deny access: %v", err)
+	}
+
+	// CanSubscribe doesn't apply to patterns
+	err = client.PSubscribe("secre?")
+	if err == nil || err.Error() != "Subscribe error: Channel refused" {
+		t.Fatalf("Did not properly deny access: %v", err)
+	}
+
+	err = client.PSubscribe("news.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalPatterns["news.*"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("weather", "Sunny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.Publish("news.sports", "Goal!")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m.Channel() != "news.sports" || m.Pattern() != "news.*" || m.Body() != "Goal!" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	err = client.PUnsubscribe("news.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if len(stats.LocalPatterns) == 0 {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func testSubscribeMany(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel != "c"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	failed, err := client.SubscribeMany([]string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed["c"] == nil || failed["c"].Error() != "Subscribe error: Channel refused" {
+		t.Fatalf("Unexpected failures: %#v", failed)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["a"] != 1 || stats.LocalSubscriptions["b"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	// Reconnecting resubscribes in one go
+	client.getTransport().Close()
+	for server.Broadcaster.metrics.subscribes.Load() != 4 {
+		<-time.After(100 * time.Millisecond)
+	}
+
+	ready = false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["a"] != 1 || stats.LocalSubscriptions["b"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("b", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m.Channel() != "b" || m.Body() != "Test message" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	failed, err = client.UnsubscribeMany([]string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("Unexpected failures: %#v", failed)
+	}
+
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if len(stats.LocalSubscriptions) == 0 {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func testAck(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		RequireAck: func(channel string) bool {
+			return channel == "test"
+		},
+		AckTimeout: 500 * time.Millisecond,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.ManualAck = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != "message" || m.Body() != "Test message" || !m.NeedsAck() {
+		t.Fatalf("Wrong message payload: %#v", m)
+	}
+
+	// Not acked: redelivered
+	m = <-client.Messages
+	if m.Type() != "message" || m.Body() != "Test message" || m.ID() != "1" {
+		t.Fatalf("Wrong message payload: %#v", m)
+	}
+
+	err = client.Ack(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		pending, err := server.Broadcaster.Backend.GetPending([]string{client.resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending[client.resume]) == 0 {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+
+	// Unacked messages follow the client when it reconnects
+	err = server.Broadcaster.Publish("test", "Second message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = <-client.Messages
+	if m.Body() != "Second message" {
+		t.Fatalf("Wrong message payload: %#v", m)
+	}
+
+	token := client.Token()
+	resume := client.resume
+	client.getTransport().Close()
+	for {
+		client.reconnect_lock.Lock()
+		reconnected := client.Token() != token
+		client.reconnect_lock.Unlock()
+		if reconnected {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+
+	m = <-client.Messages
+	if m.Body() != "Second message" || m.ID() != "2" {
+		t.Fatalf("Wrong message payload: %#v", m)
+	}
+
+	pending, err := server.Broadcaster.Backend.GetPending([]string{resume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending[resume]) != 0 {
+		t.Errorf("Unexpected pending messages for old connection: %#v", pending)
+	}
+}
+
+func testAutoAck(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		RequireAck: func(channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if !m.NeedsAck() {
+		t.Fatalf("Wrong message payload: %#v", m)
+	}
+
+	for {
+		pending, err := server.Broadcaster.Backend.GetPending([]string{client.resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending[client.resume]) == 0 {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func testSubscribeFunc(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	release := make(chan bool)
+	slow := make(chan Message, 1)
+	err = client.SubscribeFunc("slow", func(m Message) {
+		<-release
+		slow <- m
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type payload struct {
+		Value int `json:"value"`
+	}
+	fast := make(chan payload, 1)
+	err = client.SubscribeFunc("fast", func(m Message) {
+		p := payload{}
+		err := m.Decode(&p)
+		if err != nil {
+			t.Error(err)
+		}
+		fast <- p
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["slow"] != 1 || stats.LocalSubscriptions["fast"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("slow", "Slow message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = server.Broadcaster.PublishJSON("fast", payload{Value: 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The slow handler doesn't block other channels
+	select {
+	case p := <-fast:
+		if p.Value != 42 {
+			t.Errorf("Wrong payload: %#v", p)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Blocked by slow handler")
+	}
+
+	close(release)
+	m := <-slow
+	if m.Channel != "slow" || m.Body != "Slow message" || m.ID != "1" || m.Time.IsZero() {
+		t.Errorf("Wrong message: %#v", m)
+	}
+
+	// Nothing ends up in Messages
+	select {
+	case m := <-client.Messages:
+		t.Errorf("Unexpected message: %#v", m)
+	default:
+	}
+}
+
+func testContext(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	block := make(chan bool)
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			if channel == "blocked" {
+				<-block
+			}
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	defer close(block)
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = client.SubscribeContext(ctx, "blocked")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+
+	// Timeout applies as well
+	client.Timeout = 200 * time.Millisecond
+	err = client.Subscribe("blocked")
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+
+	client.results_lock.Lock()
+	_, ok := client.results["subscribe_blocked"]
+	client.results_lock.Unlock()
+	if ok {
+		t.Error("Result channel not cleaned up")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	err = client.UnsubscribeContext(ctx, "test")
+	if err != context.Canceled {
+		t.Fatalf("Expected cancel error, got %v", err)
+	}
+}
+
+func testReconnectPolicy(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	refuse := atomic.NewBool(false)
+	server, err := startServer(&Server{
+		CanConnect: func(data map[string]interface{}) bool {
+			return !refuse.Load()
+		},
+		CanPSubscribe: func(data map[string]interface{}, pattern string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	reconnected := make(chan []ResubscribeResult, 1)
+	gaveUp := make(chan error, 1)
+	attempts := atomic.NewInt64(0)
+	client, err := clientFn(server, func(c *Client) {
+		c.Reconnect = &ReconnectPolicy{
+			InitialDelay: 10 * time.Millisecond,
+			MaxDelay:     50 * time.Millisecond,
+			Jitter:       0.5,
+			MaxAttempts:  3,
+			OnReconnecting: func(attempt int, delay time.Duration) {
+				attempts.Inc()
+				if delay > 50*time.Millisecond {
+					t.Errorf("Delay exceeds maximum: %s", delay)
+				}
+			},
+			OnReconnected: func(attempt int, results []ResubscribeResult) {
+				reconnected <- results
+			},
+			OnGiveUp: func(err error) {
+				gaveUp <- err
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PSubscribe("test.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Results are reported per channel
+	client.getTransport().Close()
+	results := <-reconnected
+	if len(results) != 3 {
+		t.Fatalf("Unexpected results: %#v", results)
+	}
+	for _, r := range results {
+		if r.Err != nil || r.Pattern != (r.Channel == "test.*") {
+			t.Errorf("Unexpected result: %#v", r)
+		}
+	}
+
+	// Stops after MaxAttempts
+	refuse.Store(true)
+	attempts.Store(0)
+	client.getTransport().Close()
+	err = <-gaveUp
+	var cErr *CloseError
+	if !errors.As(err, &cErr) || cErr.Code != 4401 {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("Expected 3 attempts, got %d", attempts.Load())
+	}
+
+	select {
+	case <-client.Disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Not disconnected")
+	}
+
+	// Doesn't reconnect without any attempts
+	refuse.Store(false)
+	attempts.Store(0)
+	once, err := clientFn(server, func(c *Client) {
+		c.Reconnect = &ReconnectPolicy{
+			OnReconnecting: func(attempt int, delay time.Duration) {
+				attempts.Inc()
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer once.Disconnect()
+
+	once.getTransport().Close()
+	select {
+	case <-once.Disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Not disconnected")
+	}
+	if attempts.Load() != 0 {
+		t.Errorf("Expected no attempts, got %d", attempts.Load())
+	}
+}
+
+func testResubscribeRefused(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	refuse := atomic.NewBool(false)
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel == "test" || !refuse.Load()
+		},
+		CanPSubscribe: func(data map[string]interface{}, pattern string) bool {
+			return !refuse.Load()
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	reconnected := make(chan []ResubscribeResult, 1)
+	client, err := clientFn(server, func(c *Client) {
+		c.Reconnect = &ReconnectPolicy{
+			MaxAttempts: UnlimitedAttempts,
+			OnReconnected: func(attempt int, results []ResubscribeResult) {
+				reconnected <- results
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	_, err = client.SubscribeMany([]string{"test", "refused"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.PSubscribe("refused.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refuse.Store(true)
+	client.getTransport().Close()
+	results := <-reconnected
+	if len(results) != 3 {
+		t.Fatalf("Unexpected results: %#v", results)
+	}
+	for _, r := range results {
+		if (r.Err == nil) != (r.Channel == "test") {
+			t.Errorf("Unexpected result: %#v", r)
+		}
+	}
+}
+
+func TestReconnectDelay(t *testing.T) {
+	p := &ReconnectPolicy{
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     1 * time.Second,
+	}
+
+	expected := []time.Duration{
+		0,
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		1 * time.Second,
+		1 * time.Second,
+	}
+	for i, e := range expected {
+		d := p.delay(i + 1)
+		if d != e {
+			t.Errorf("Attempt %d: expected %s, got %s", i+1, e, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.delay(3)
+		if d < 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Errorf("Delay out of range: %s", d)
+		}
+	}
+}
+
+func testState(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	states := make(chan ClientState, 10)
+	client, err := clientFn(server, func(c *Client) {
+		if c.State() != ClientStateDisconnected || c.Transport() != ClientModeAuto {
+			t.Errorf("Unexpected initial state: %s", c.State())
+		}
+		c.OnStateChange = func(state ClientState) {
+			if state == ClientStateClosed {
+				// Doesn't deadlock
+				c.Disconnect()
+			}
+			states <- state
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if client.State() != ClientStateConnected {
+		t.Errorf("Unexpected state: %s", client.State())
+	}
+	if client.Transport() != client.Mode {
+		t.Errorf("Unexpected transport: %d", client.Transport())
+	}
+
+	client.getTransport().Close()
+	expected := []ClientState{
+		ClientStateConnecting,
+		ClientStateConnected,
+		ClientStateReconnecting,
+		ClientStateConnected,
+		ClientStateClosed,
+	}
+	for i, e := range expected {
+		if e == ClientStateClosed {
+			err = client.Disconnect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if client.State() != ClientStateClosed {
+				t.Errorf("Unexpected state: %s", client.State())
+			}
+		}
+
+		select {
+		case state := <-states:
+			if state != e {
+				t.Errorf("Unexpected state change %d: %s, expected %s", i, state, e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Missing state change %d: %s", i, e)
+		}
+	}
+}
+
+func transportCodec(c *Client) Codec {
+	switch t := c.getTransport().(type) {
+	case *websocketClientTransport:
+		return t.codec
+	case *longpollClientTransport:
+		return t.codec
+	case *sseClientTransport:
+		return t.codec
+	}
+	return nil
+}
+
+func testCodec(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		HistoryLength: 10,
+		Codecs:        []Codec{MessagePack},
+		CanPublish: func(data map[string]interface{}, channel, body string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.Codec = MessagePack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	if transportCodec(client) != MessagePack {
+		t.Fatalf("Codec not negotiated: %v", transportCodec(client))
+	}
+
+	err = server.Broadcaster.Publish("test", "History message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Subscribe("test", SubscribeSince("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-client.Messages
+	if m.Type() != MessageMessage || m.Channel() != "test" || m.Body() != "History message" || m.ID() != "1" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = client.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m = <-client.Messages
+	if m.Type() != MessageMessage || m.Channel() != "test" || m.Body() != "Test message" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+
+	// Falls back to JSON when the server doesn't support it
+	jsonServer, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer jsonServer.Stop()
+
+	other, err := clientFn(jsonServer, func(c *Client) {
+		c.Codec = MessagePack
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+
+	if transportCodec(other) != JSON {
+		t.Fatalf("Unexpected codec: %v", transportCodec(other))
+	}
+	err = other.Subscribe("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAuthenticator(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	published := make(chan string, 1)
+	server, err := startServer(&Server{
+		Authenticator: AuthenticatorFunc(func(data map[string]interface{}) (*Identity, error) {
+			user, _ := data["user"].(string)
+			if user == "" {
+				return nil, errors.New("Missing user")
+			}
+			identity := &Identity{UserID: user}
+			if user == "admin" {
+				identity.Roles = []string{"admin"}
+			}
+			if ms, ok := data["expires"].(float64); ok {
+				identity.Expires = time.Unix(0, int64(ms)*int64(time.Millisecond))
+			}
+			return identity, nil
+		}),
+		AuthorizeSubscribe: func(identity *Identity, channel string) bool {
+			return channel != "admin" || identity.HasRole("admin")
+		},
+		AuthorizePublish: func(identity *Identity, channel, body string) bool {
+			published <- identity.UserID
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Refused with the reason of the authenticator
+	_, err = clientFn(server)
+	var cErr *CloseError
+	if err == nil || !errors.As(err, &cErr) || cErr.Code != 4401 || cErr.Text != "Missing user" {
+		t.Fatalf("Did not properly deny access %v", err)
+	}
+
+	// Identity is passed to the hooks
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "bob"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("admin")
+	if err == nil {
+		t.Error("Expected admin channel to be refused")
+	}
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Publish("test", "Hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := <-published; user != "bob" {
+		t.Errorf("Unexpected publisher: %s", user)
+	}
+	if !client.Expires().IsZero() {
+		t.Errorf("Unexpected expiry: %s", client.Expires())
+	}
+
+	// Credentials that expire, refreshed in time
+	expires := func(d time.Duration) float64 {
+		return float64(time.Now().Add(d).UnixNano() / int64(time.Millisecond))
+	}
+	gaveUp := make(chan error, 1)
+	expiring, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "alice", "expires": expires(1500 * time.Millisecond)}
+		c.Reconnect = &ReconnectPolicy{
+			MaxAttempts: 1,
+			OnGiveUp: func(err error) {
+				gaveUp <- err
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer expiring.Disconnect()
+
+	if expiring.Expires().IsZero() {
+		t.Fatal("Expected expiry")
+	}
+	first := expiring.Expires()
+
+	err = expiring.Reauth(map[string]interface{}{"user": "bob", "expires": expires(time.Minute)})
+	if err == nil || err.Error() != "Reauth error: Identity changed" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err = expiring.Reauth(map[string]interface{}{"user": "alice", "expires": expires(2 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !expiring.Expires().After(first) {
+		t.Errorf("Expiry not updated: %s", expiring.Expires())
+	}
+
+	// Still connected after the first expiry
+	<-time.After(1500 * time.Millisecond)
+	err = expiring.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Disconnected once the new credentials expire, reconnecting with
+	// them fails
+	select {
+	case err = <-gaveUp:
+		if !errors.As(err, &cErr) || cErr.Text != "Credentials expired" {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Not disconnected")
+	}
+}
+
+func testSignedChannel(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		ChannelSecret: []byte("secret"),
+		Authenticator: AuthenticatorFunc(func(data map[string]interface{}) (*Identity, error) {
+			user, _ := data["user"].(string)
+			return &Identity{UserID: user}, nil
+		}),
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			return channel == "public"
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	reconnected := make(chan []ResubscribeResult, 1)
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"user": "bob"}
+		c.Reconnect = &ReconnectPolicy{
+			MaxAttempts: UnlimitedAttempts,
+			OnReconnected: func(attempt int, results []ResubscribeResult) {
+				reconnected <- results
+			},
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Falls back to CanSubscribe
+	err = client.Subscribe("public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.Subscribe("private")
+	if err == nil {
+		t.Fatal("Expected unsigned subscribe to be refused")
+	}
+
+	expires := time.Now().Add(time.Minute)
+	sign := func(user, channel string, expires time.Time) string {
+		signature, err := server.Broadcaster.SignChannel(user, channel, expires)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+
+	refused := []SubscribeOption{
+		SubscribeSigned(sign("alice", "private", expires), expires),
+		SubscribeSigned(sign("bob", "other", expires), expires),
+		SubscribeSigned(sign("bob", "private", expires), expires.Add(time.Minute)),
+		SubscribeSigned(sign("bob", "private", time.Now().Add(-time.Second)), time.Now().Add(-time.Second)),
+	}
+	for i, opt := range refused {
+		err = client.Subscribe("private", opt)
+		if err == nil {
+			t.Errorf("Expected signature %d to be refused", i)
+		}
+	}
+
+	err = client.Subscribe("private", SubscribeSigned(sign("bob", "private", expires), expires))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Still valid after reconnecting
+	client.getTransport().Close()
+	results := <-reconnected
+	if len(results) != 2 {
+		t.Fatalf("Unexpected results: %#v", results)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Errorf("Resubscribe to %s failed: %s", r.Channel, r.Err)
+		}
+	}
+}
+
+func testHistoryLive(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	// Publishes a message while subscribing, right before the history is
+	// read.
+	var server *testServer
+	subscribing := atomic.NewBool(false)
+	server, err := startServer(&Server{
+		HistoryLength: 10,
+		KeepHistory: func(channel string) bool {
+			if subscribing.CAS(true, false) {
+				server.Broadcaster.Publish(channel, "4")
+			}
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	for _, msg := range []string{"1", "2", "3"} {
+		err = server.Broadcaster.Publish("test", msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	subscribing.Store(true)
+	err = client.Subscribe("test", SubscribeSince("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] == 1 {
+			break
+		}
+		<-time.After(10 * time.Millisecond)
+	}
+	err = server.Broadcaster.Publish("test", "5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// In order and without duplicates
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		select {
+		case m := <-client.Messages:
+			if m.ID() != id {
+				t.Fatalf("Expected message %s, got %#v", id, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for message %s", id)
+		}
+	}
+}
+
+func testSubscribeManyLarge(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Makes sure a listener is active
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Split across two batches, way more than fit in a listener's buffers
+	channels := make([]string, 0)
+	for i := 0; i < MaxBatchSize+50; i++ {
+		channels = append(channels, fmt.Sprintf("channel.%d", i))
+	}
+	failed, err := client.SubscribeMany(channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("Unexpected failures: %#v", failed)
+	}
+
+	timeout := time.After(5 * time.Second)
+	for {
+		result := make(chan Stats, 1)
+		go func() {
+			stats, _ := server.Broadcaster.Stats()
+			result <- stats
+		}()
+
+		select {
+		case stats := <-result:
+			if len(stats.LocalSubscriptions) == len(channels)+1 {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Subscriptions did not go through")
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
+
+func testResumeOwnership(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		RequireAck: func(channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.ManualAck = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	err = server.Broadcaster.Publish("test", "Test message")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-client.Messages
+
+	// Knowing the token isn't enough to take over pending messages
+	other, err := clientFn(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Disconnect()
+
+	_, err = other.subscribeMany(context.Background(), []ClientMessage{
+		{"channel": "test", "resume": client.Token()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := server.Broadcaster.Backend.GetPending([]string{client.resume, other.resume})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending[client.resume]) != 1 || len(pending[other.resume]) != 0 {
+		t.Errorf("Unexpected pending messages: %#v", pending)
+	}
+}
+
+func testConnectResubscribeFails(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	block := make(chan bool)
+	server, err := startServer(&Server{
+		CanSubscribe: func(data map[string]interface{}, channel string) bool {
+			if channel == "blocked" {
+				<-block
+			}
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+	defer close(block)
+
+	var client *Client
+	_, err = clientFn(server, func(c *Client) {
+		client = c
+		c.Timeout = 200 * time.Millisecond
+		c.channels["blocked"] = true
+	})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline error, got %v", err)
+	}
+	defer client.Disconnect()
+
+	// Transport is closed and doesn't reconnect by itself
+	if client.getTransport() != nil {
+		t.Error("Transport left behind")
+	}
+	if client.State() != ClientStateDisconnected {
+		t.Errorf("Unexpected state: %v", client.State())
+	}
+	<-time.After(500 * time.Millisecond)
+	if client.getTransport() != nil || client.State() != ClientStateDisconnected {
+		t.Error("Reconnected after failing")
+	}
+}
+
+func testForgedIdentity(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	identities := make(chan *Identity, 1)
+	data := make(chan map[string]interface{}, 1)
+	server, err := startServer(&Server{
+		AuthorizeSubscribe: func(identity *Identity, channel string) bool {
+			identities <- identity
+			return true
+		},
+		CanSubscribe: func(auth map[string]interface{}, channel string) bool {
+			data <- auth
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{
+			"name":      "test",
+			identityKey: map[string]interface{}{"user_id": "admin", "roles": []string{"admin"}},
+			resumeKey:   "forged",
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No Authenticator, so no identity
+	if identity := <-identities; identity != nil {
+		t.Errorf("Unexpected identity: %#v", identity)
+	}
+	auth := <-data
+	if auth["name"] != "test" || auth[identityKey] != nil || auth["__type"] != nil {
+		t.Errorf("Unexpected auth data: %#v", auth)
+	}
+	if client.resume == "forged" {
+		t.Error("Resume key taken from the client")
+	}
+}
+
+func testConcurrentPublish(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		CanPublish: func(data map[string]interface{}, channel, body string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := clientFn(server, func(c *Client) {
+		c.Timeout = 5 * time.Second
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Replies on the same channel don't get mixed up
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			errs <- client.Publish("chat", "hi")
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		err := <-errs
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func testSlowAck(t *testing.T, clientFn func(s *testServer, conf ...func(c *Client)) (*Client, error)) {
+	server, err := startServer(&Server{
+		RequireAck: func(channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Acks take a while to handle
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Error(err)
+			}
+			if bytes.Contains(body, []byte(`"__type":"ack"`)) {
+				time.Sleep(300 * time.Millisecond)
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		server.Broadcaster.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	client, err := clientFn(&testServer{Port: ts.Listener.Addr().(*net.TCPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err = server.Broadcaster.Publish("test", fmt.Sprintf("Message %d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Acking doesn't hold up receiving
+	for i := 0; i < 3; i++ {
+		m := <-client.Messages
+		if m.Body() != fmt.Sprintf("Message %d", i) {
+			t.Fatalf("Wrong message payload: %#v", m)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Receiving took %s", elapsed)
+	}
+
+	for {
+		pending, err := server.Broadcaster.Backend.GetPending([]string{client.resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending[client.resume]) == 0 {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+}
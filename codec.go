@@ -0,0 +1,105 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// A Codec encodes client messages on the wire. Clients pick one when
+// authenticating (see Client.Codec), the server uses it once it accepts.
+// Authentication itself always uses JSON.
+//
+// Decoded messages should use the same types as encoding/json does when
+// decoding into an interface{}, message handling depends on it.
+type Codec interface {
+	// Name used when negotiating, e.g. "msgpack"
+	Name() string
+
+	// Content type of long-poll requests and replies
+	ContentType() string
+
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// Codecs that are included
+var (
+	JSON        Codec = jsonCodec{}
+	MessagePack Codec = msgpackCodec{}
+)
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSON is the only text-based codec.
+func isTextCodec(codec Codec) bool {
+	return codec.Name() == JSON.Name()
+}
+
+// Encodes a websocket frame: JSON is sent in text frames, everything else in
+// binary frames.
+func encodeFrame(codec Codec, v interface{}) (int, []byte, error) {
+	data, err := codec.Marshal(v)
+	if err != nil {
+		return 0, nil, err
+	}
+	if isTextCodec(codec) {
+		return websocket.TextMessage, data, nil
+	}
+	return websocket.BinaryMessage, data, nil
+}
+
+// Decodes a websocket frame, text frames are always JSON.
+func decodeFrame(codec Codec, messageType int, data []byte, v interface{}) error {
+	if messageType == websocket.TextMessage {
+		codec = JSON
+	}
+	return codec.Unmarshal(data, v)
+}
+
+// Looks up a codec requested by a client, falls back to JSON when the
+// server doesn't support it.
+func (s *Server) codec(name string) Codec {
+	for _, c := range s.Codecs {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return JSON
+}
+
+// Codec used by a long-poll request, based on its content type.
+func (s *Server) requestCodec(r *http.Request) Codec {
+	return codecForContentType(s.Codecs, r.Header.Get("Content-Type"))
+}
+
+func codecForContentType(codecs []Codec, contentType string) Codec {
+	t, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return JSON
+	}
+	for _, c := range codecs {
+		if c.ContentType() == t {
+			return c
+		}
+	}
+	return JSON
+}
@@ -0,0 +1,77 @@
+package broadcaster
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// Gzips long-poll replies of at least minSize bytes. Each reply is a single
+// write, so the choice is made on the first one.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	level   int
+	minSize int
+
+	status  int
+	written bool
+	gz      *gzip.Writer
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		if enc == "gzip" || strings.HasPrefix(enc, "gzip;") {
+			return true
+		}
+	}
+	return false
+}
+
+func newGzipResponseWriter(w http.ResponseWriter, level, minSize int) *gzipResponseWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	return &gzipResponseWriter{
+		ResponseWriter: w,
+		level:          level,
+		minSize:        minSize,
+	}
+}
+
+// Delayed until we know whether the body gets compressed.
+func (w *gzipResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		if len(b) >= w.minSize {
+			gz, err := gzip.NewWriterLevel(w.ResponseWriter, w.level)
+			if err != nil {
+				return 0, err
+			}
+			w.gz = gz
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Del("Content-Length")
+		}
+		if w.status != 0 {
+			w.ResponseWriter.WriteHeader(w.status)
+		}
+	}
+
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Sends a pending status code and finishes the compressed stream.
+func (w *gzipResponseWriter) Close() error {
+	if !w.written && w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
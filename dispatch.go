@@ -0,0 +1,158 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Decode unmarshals the JSON body of a message, see Server.PublishJSON.
+func (m Message) Decode(v interface{}) error {
+	return json.Unmarshal([]byte(m.Body), v)
+}
+
+// Passes the messages of a channel to its handler. Runs on a separate
+// goroutine with a bounded queue, so a slow handler doesn't block other
+// channels.
+type dispatcher struct {
+	client   *Client
+	handler  func(Message)
+	size     int
+	policy   OverflowPolicy
+	overflow func()
+
+	queue      []ClientMessage
+	queue_lock sync.Mutex
+	overflowed bool
+	wake       chan struct{}
+	quit       chan struct{}
+}
+
+func newDispatcher(c *Client, handler func(Message), overflow func()) *dispatcher {
+	d := &dispatcher{
+		client:   c,
+		handler:  handler,
+		size:     c.HandlerQueueSize,
+		policy:   c.HandlerOverflowPolicy,
+		overflow: overflow,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Never blocks, applies the overflow policy when full. Dropped messages
+// aren't acked, so the server redelivers them.
+func (d *dispatcher) push(m ClientMessage) {
+	d.queue_lock.Lock()
+	if d.overflowed {
+		d.queue_lock.Unlock()
+		return
+	}
+	if d.size > 0 && len(d.queue) >= d.size {
+		switch d.policy {
+		case OverflowDropNewest:
+			d.queue_lock.Unlock()
+			return
+		case OverflowDisconnect:
+			d.overflowed = true
+			d.queue_lock.Unlock()
+			go d.overflow()
+			return
+		default:
+			d.queue = d.queue[1:]
+		}
+	}
+	d.queue = append(d.queue, m)
+	d.queue_lock.Unlock()
+
+	select {
+	case d.wake <- struct{}{}:
+	default: // Already woken up
+	}
+}
+
+func (d *dispatcher) stop() {
+	close(d.quit)
+}
+
+func (d *dispatcher) run() {
+	for {
+		select {
+		case <-d.wake:
+		case <-d.quit:
+			return
+		}
+
+		for {
+			d.queue_lock.Lock()
+			if len(d.queue) == 0 {
+				d.queue_lock.Unlock()
+				break
+			}
+			m := d.queue[0]
+			d.queue = d.queue[1:]
+			d.queue_lock.Unlock()
+
+			d.handler(m.AsMessage())
+			d.client.Ack(m)
+		}
+	}
+}
+
+// SubscribeFunc subscribes to a channel and calls fn for every message on it,
+// instead of passing them to Messages. Each channel has its own goroutine:
+// calls for one channel are sequential, but a slow handler doesn't hold up
+// other channels.
+//
+// Messages that need to be acknowledged are acked once fn returns, ManualAck
+// doesn't apply. Messages are queued up to HandlerQueueSize, see
+// HandlerOverflowPolicy.
+func (c *Client) SubscribeFunc(channel string, fn func(Message), opts ...SubscribeOption) error {
+	// Set up the handler first, replayed messages follow the subscribe
+	// result immediately.
+	d := newDispatcher(c, fn, func() {
+		c.Unsubscribe(channel)
+	})
+	c.handlers_lock.Lock()
+	if previous, ok := c.handlers[channel]; ok {
+		previous.stop()
+	}
+	c.handlers[channel] = d
+	c.handlers_lock.Unlock()
+
+	err := c.Subscribe(channel, opts...)
+	if err != nil {
+		c.removeHandler(channel)
+		return err
+	}
+	return nil
+}
+
+// Passes a message to its handler, if there is one.
+func (c *Client) dispatch(m ClientMessage) bool {
+	if m.Pattern() != "" {
+		return false
+	}
+
+	c.handlers_lock.Lock()
+	d, ok := c.handlers[m.Channel()]
+	c.handlers_lock.Unlock()
+	if !ok {
+		return false
+	}
+
+	c.setLastID(m)
+	d.push(m)
+	return true
+}
+
+func (c *Client) removeHandler(channel string) {
+	c.handlers_lock.Lock()
+	defer c.handlers_lock.Unlock()
+
+	if d, ok := c.handlers[channel]; ok {
+		d.stop()
+		delete(c.handlers, channel)
+	}
+}
@@ -1,8 +1,10 @@
 package broadcaster
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"time"
 )
 
 // Pass options to Server to configure Redis etc.
@@ -36,3 +38,66 @@ func ExampleServer_ServeHTTP() {
 
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
+
+// Sending a message to all subscribers of a channel
+func ExampleServer_Publish() {
+	s := &Server{}
+
+	// Always call Prepare() first!
+	err := s.Prepare()
+	if err != nil {
+		panic(err)
+	}
+
+	err = s.Publish("news", "Hello world!")
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Stopping a server gracefully
+func ExampleServer_Shutdown() {
+	s := &Server{}
+
+	// Always call Prepare() first!
+	err := s.Prepare()
+	if err != nil {
+		panic(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = s.Shutdown(ctx)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Handling the messages of a channel in a callback
+func ExampleClient_SubscribeFunc() {
+	c, err := NewClient("https://example.com/broadcaster/")
+	if err != nil {
+		panic(err)
+	}
+
+	err = c.Connect()
+	if err != nil {
+		panic(err)
+	}
+
+	err = c.SubscribeFunc("news", func(m Message) {
+		var article struct {
+			Title string `json:"title"`
+		}
+		err := m.Decode(&article)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		log.Printf("%s: %s", m.Channel, article.Title)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,140 @@
+package broadcaster
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A Message is a message published on a channel.
+type Message struct {
+	Channel string    `json:"channel"`
+	Body    string    `json:"body"`
+	Pattern string    `json:"pattern,omitempty"`
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+}
+
+func (s *Server) keepHistory(channel string) bool {
+	if s.HistoryLength <= 0 {
+		return false
+	}
+	return s.KeepHistory == nil || s.KeepHistory(channel)
+}
+
+// Stores a published message in the channel history, if enabled.
+func (s *Server) storeHistory(m Message) error {
+	if !s.keepHistory(m.Channel) {
+		return nil
+	}
+	return s.Backend.StoreHistory(m.Channel, m, s.HistoryLength, s.HistoryTTL)
+}
+
+// Returns the messages that should be replayed for a subscribe request, if
+// it asked for them.
+func (s *Server) history(channel string, m ClientMessage) ([]ClientMessage, error) {
+	since, _ := m["since"].(string)
+	sinceTime, _ := m["sinceTime"].(float64)
+	if since == "" && sinceTime == 0 {
+		return nil, nil
+	}
+	if !s.keepHistory(channel) {
+		return nil, nil
+	}
+
+	var sinceID int64
+	if since != "" {
+		id, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return nil, errors.New("Invalid message id")
+		}
+		sinceID = id
+	}
+	after := time.Unix(0, int64(sinceTime)*int64(time.Millisecond))
+
+	messages, err := s.Backend.GetHistory(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ClientMessage, 0)
+	for _, msg := range messages {
+		if since != "" {
+			id, err := strconv.ParseInt(msg.ID, 10, 64)
+			if err != nil || id <= sinceID {
+				continue
+			}
+		}
+		if sinceTime != 0 && !msg.Time.After(after) {
+			continue
+		}
+		result = append(result, newBroadcastMessage(msg))
+	}
+	return result, nil
+}
+
+// Combines replayed history with resumed pending messages, ordered by id
+// and without duplicates. Pending copies win, they need to be acked.
+func mergeReplay(history, pending []ClientMessage) []ClientMessage {
+	if len(pending) == 0 {
+		return history
+	}
+
+	seen := make(map[string]bool)
+	result := make([]ClientMessage, 0, len(history)+len(pending))
+	for _, m := range pending {
+		seen[m.ID()] = true
+		result = append(result, m)
+	}
+	for _, m := range history {
+		if !seen[m.ID()] {
+			result = append(result, m)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return idBefore(result[i].ID(), result[j].ID())
+	})
+	return result
+}
+
+func idBefore(a, b string) bool {
+	x, err := strconv.ParseInt(a, 10, 64)
+	if err != nil {
+		return false
+	}
+	y, err := strconv.ParseInt(b, 10, 64)
+	if err != nil {
+		return false
+	}
+	return x < y
+}
+
+// Subscribe result. When messages are replayed, it holds the id of the last
+// one: clients drop live copies of the replayed messages up to that id.
+func newSubscribeOKMessage(channel string, replay []ClientMessage) ClientMessage {
+	m := newChannelMessage(SubscribeOKMessage, channel)
+	if len(replay) > 0 {
+		m["id"] = replay[len(replay)-1].ID()
+	}
+	return m
+}
+
+// Options for Client.Subscribe
+type SubscribeOption func(m ClientMessage)
+
+// SubscribeSince requests all messages published after the message with the
+// given id to be replayed.
+func SubscribeSince(id string) SubscribeOption {
+	return func(m ClientMessage) {
+		m["since"] = id
+	}
+}
+
+// SubscribeSinceTime requests all messages published after the given time to
+// be replayed.
+func SubscribeSinceTime(t time.Time) SubscribeOption {
+	return func(m ClientMessage) {
+		m["sinceTime"] = t.UnixNano() / int64(time.Millisecond)
+	}
+}
@@ -1,66 +1,116 @@
 package broadcaster
 
 import (
+	"encoding/json"
 	"errors"
+	"hash/fnv"
+	"runtime"
 	"strings"
 	"sync"
-
-	"github.com/gomodule/redigo/redis"
 )
 
 type connection interface {
-	Send(channel, message string)
+	Send(m Message)
+	Notify(m ClientMessage)
 	Process(t string, args []string)
+	Shutdown()
 	GetToken() string
+	GetTransport() string
+}
+
+// A channel or pattern subscription
+type subscription struct {
+	Channel string
+	Pattern bool
 }
 
+var errHubStopped = errors.New("Server shutting down")
+
 type subscriptionRequest struct {
 	Connection connection
 	Channel    string
+	Pattern    bool
 	Done       chan error
 }
 
 type hub struct {
 	quit chan struct{}
 
-	redis *redisBackend
+	backend Backend
+
+	// Number of workers, channels and patterns are partitioned across
+	// them. Defaults to 1.
+	shardCount int
+	shards     []*hubShard
+
+	// Keeps track of all channels and patterns a connection is subscribed to.
+	subscriptions map[connection]map[subscription]bool
+
+	// Maps tokens to connections. Long-polling clients can briefly have
+	// multiple connections with the same token.
+	connections map[string]map[connection]bool
+
+	// Guards subscriptions and connections. Never take a shard lock while
+	// holding it.
+	sync.Mutex
+}
 
-	// Keeps track of all channels a connection is subscribed to.
-	subscriptions map[connection]map[string]bool
+// A hub worker, owns the subscribers of a part of the channels and patterns.
+type hubShard struct {
+	hub *hub
 
 	// Allows mapping channels to subscribers.
 	channels map[string]map[connection]bool
 
-	// Makes tokens to connections
-	connections map[string]connection
+	// Allows mapping patterns to subscribers.
+	patterns map[string]map[connection]bool
+
+	// Number of messages sent to connections
+	relayed int64
 
 	newSubscriptions   chan subscriptionRequest
 	newUnsubscriptions chan subscriptionRequest
+	messages           chan BackendMessage
 
 	sync.Mutex
 }
 
+// Subscriber sets of at least this size are fanned out in parallel.
+const parallelFanOut = 1000
+
 func (h *hub) Prepare() error {
 	h.quit = make(chan struct{})
 
-	h.subscriptions = make(map[connection]map[string]bool)
-	h.channels = make(map[string]map[connection]bool)
-	h.connections = make(map[string]connection)
+	h.subscriptions = make(map[connection]map[subscription]bool)
+	h.connections = make(map[string]map[connection]bool)
 
-	h.newSubscriptions = make(chan subscriptionRequest, 100)
-	h.newUnsubscriptions = make(chan subscriptionRequest, 100)
+	if h.shardCount <= 0 {
+		h.shardCount = 1
+	}
+	h.shards = make([]*hubShard, h.shardCount)
+	for i := range h.shards {
+		h.shards[i] = &hubShard{
+			hub:                h,
+			channels:           make(map[string]map[connection]bool),
+			patterns:           make(map[string]map[connection]bool),
+			newSubscriptions:   make(chan subscriptionRequest, 100),
+			newUnsubscriptions: make(chan subscriptionRequest, 100),
+			messages:           make(chan BackendMessage, 100),
+		}
+	}
 
 	return nil
 }
 
+// Passes backend messages to the shards.
 func (h *hub) Run() {
+	for _, shard := range h.shards {
+		go shard.Run()
+	}
+
 	for {
 		select {
-		case r := <-h.newSubscriptions:
-			h.handleSubscribe(r)
-		case r := <-h.newUnsubscriptions:
-			h.handleUnsubscribe(r)
-		case m := <-h.redis.Messages:
+		case m := <-h.backend.Messages():
 			h.handleMessage(m)
 		case <-h.quit:
 			return
@@ -69,15 +119,64 @@ func (h *hub) Run() {
 }
 
 func (h *hub) Stop() {
-	h.quit <- struct{}{}
+	close(h.quit)
+}
+
+// Shard that owns a channel or pattern
+func (h *hub) shard(channel string) *hubShard {
+	if len(h.shards) == 1 {
+		return h.shards[0]
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(channel))
+	return h.shards[hash.Sum32()%uint32(len(h.shards))]
+}
+
+func (s *hubShard) Run() {
+	for {
+		select {
+		case r := <-s.newSubscriptions:
+			s.handleSubscribe(r)
+		case r := <-s.newUnsubscriptions:
+			s.handleUnsubscribe(r)
+		case m := <-s.messages:
+			s.handleMessage(m)
+		case <-s.hub.quit:
+			return
+		}
+	}
+}
+
+// Shuts down all connections
+func (h *hub) Shutdown() {
+	h.Lock()
+	conns := make([]connection, 0, len(h.subscriptions))
+	for conn, _ := range h.subscriptions {
+		conns = append(conns, conn)
+	}
+	h.Unlock()
+
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn connection) {
+			defer wg.Done()
+			conn.Shutdown()
+		}(conn)
+	}
+	wg.Wait()
 }
 
 func (h *hub) Connect(conn connection) error {
 	h.Lock()
 	defer h.Unlock()
 
-	h.subscriptions[conn] = make(map[string]bool)
-	h.connections[conn.GetToken()] = conn
+	h.subscriptions[conn] = make(map[subscription]bool)
+	token := conn.GetToken()
+	if _, ok := h.connections[token]; !ok {
+		h.connections[token] = make(map[connection]bool)
+	}
+	h.connections[token][conn] = true
 	return nil
 }
 
@@ -86,16 +185,20 @@ func (h *hub) Disconnect(conn connection) error {
 		return errors.New("Unknown connection")
 	}
 
+	// Unsubscribe from all channels
 	h.Lock()
-	channels := make([]string, 0)
-	for channel, _ := range h.subscriptions[conn] {
-		channels = append(channels, channel)
+	subscriptions := make([]subscription, 0)
+	for s, _ := range h.subscriptions[conn] {
+		subscriptions = append(subscriptions, s)
 	}
 	h.Unlock()
 
-	// Unsubscribe from all channels
-	for _, channel := range channels {
-		err := h.Unsubscribe(conn, channel)
+	for _, s := range subscriptions {
+		err := h.unsubscribe(conn, s.Channel, s.Pattern)
+		if err == errHubStopped {
+			// Nothing left to release, just forget the connection
+			break
+		}
 		if err != nil {
 			return err
 		}
@@ -103,11 +206,42 @@ func (h *hub) Disconnect(conn connection) error {
 
 	h.Lock()
 	defer h.Unlock()
+	token := conn.GetToken()
 	delete(h.subscriptions, conn)
-	delete(h.connections, conn.GetToken())
+	delete(h.connections[token], conn)
+	if len(h.connections[token]) == 0 {
+		delete(h.connections, token)
+	}
 	return nil
 }
 
+// Whether there are other local connections with the same token
+func (h *hub) hasOtherConnections(conn connection) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	for c, _ := range h.connections[conn.GetToken()] {
+		if c != conn {
+			return true
+		}
+	}
+	return false
+}
+
+// Channels the connection is subscribed to
+func (h *hub) connectionChannels(conn connection) []string {
+	h.Lock()
+	defer h.Unlock()
+
+	channels := make([]string, 0)
+	for s, _ := range h.subscriptions[conn] {
+		if !s.Pattern {
+			channels = append(channels, s.Channel)
+		}
+	}
+	return channels
+}
+
 func (h *hub) hasConnection(conn connection) bool {
 	h.Lock()
 	defer h.Unlock()
@@ -116,7 +250,7 @@ func (h *hub) hasConnection(conn connection) bool {
 	return ok
 }
 
-func (h *hub) hasSubscription(conn connection, channel string) bool {
+func (h *hub) hasSubscription(conn connection, channel string, pattern bool) bool {
 	h.Lock()
 	defer h.Unlock()
 
@@ -125,11 +259,28 @@ func (h *hub) hasSubscription(conn connection, channel string) bool {
 		return false
 	}
 
-	_, ok = s[channel]
+	_, ok = s[subscription{channel, pattern}]
 	return ok
 }
 
+// Subscribers of a channel or pattern, lock must be held.
+func (s *hubShard) subscribers(pattern bool) map[string]map[connection]bool {
+	if pattern {
+		return s.patterns
+	}
+	return s.channels
+}
+
 func (h *hub) Subscribe(conn connection, channel string) error {
+	return h.subscribe(conn, channel, false)
+}
+
+// Subscribes to all channels matching a glob pattern
+func (h *hub) PSubscribe(conn connection, pattern string) error {
+	return h.subscribe(conn, pattern, true)
+}
+
+func (h *hub) subscribe(conn connection, channel string, pattern bool) error {
 	if !h.hasConnection(conn) {
 		return errors.New("Unknown connection")
 	}
@@ -137,32 +288,70 @@ func (h *hub) Subscribe(conn connection, channel string) error {
 	r := subscriptionRequest{
 		Connection: conn,
 		Channel:    channel,
-		Done:       make(chan error),
+		Pattern:    pattern,
+		Done:       make(chan error, 1),
 	}
-	h.newSubscriptions <- r
-	return <-r.Done
+	return h.request(h.shard(channel).newSubscriptions, r)
 }
 
-func (h *hub) handleSubscribe(r subscriptionRequest) {
-	h.Lock()
-	defer h.Unlock()
+// Hands a request to a shard and waits for it, gives up once the hub stops.
+func (h *hub) request(requests chan subscriptionRequest, r subscriptionRequest) error {
+	select {
+	case requests <- r:
+	case <-h.quit:
+		return errHubStopped
+	}
+	select {
+	case err := <-r.Done:
+		return err
+	case <-h.quit:
+		return errHubStopped
+	}
+}
 
-	if _, ok := h.channels[r.Channel]; !ok {
-		// New channel! Try to connect to Redis first
-		h.redis.Subscribe(r.Channel)
-		h.channels[r.Channel] = make(map[connection]bool)
+func (s *hubShard) handleSubscribe(r subscriptionRequest) {
+	s.Lock()
+	defer s.Unlock()
+
+	// Might have disconnected in the meantime
+	s.hub.Lock()
+	subscriptions, ok := s.hub.subscriptions[r.Connection]
+	if ok {
+		subscriptions[subscription{r.Channel, r.Pattern}] = true
+	}
+	s.hub.Unlock()
+	if !ok {
+		r.Done <- errors.New("Unknown connection")
+		return
 	}
 
-	h.subscriptions[r.Connection][r.Channel] = true
-	h.channels[r.Channel][r.Connection] = true
+	subscribers := s.subscribers(r.Pattern)
+	if _, ok := subscribers[r.Channel]; !ok {
+		// New channel! Try to connect to Redis first
+		if r.Pattern {
+			s.hub.backend.PSubscribe(r.Channel)
+		} else {
+			s.hub.backend.Subscribe(r.Channel)
+		}
+		subscribers[r.Channel] = make(map[connection]bool)
+	}
+	subscribers[r.Channel][r.Connection] = true
 	r.Done <- nil
 }
 
 func (h *hub) Unsubscribe(conn connection, channel string) error {
+	return h.unsubscribe(conn, channel, false)
+}
+
+func (h *hub) PUnsubscribe(conn connection, pattern string) error {
+	return h.unsubscribe(conn, pattern, true)
+}
+
+func (h *hub) unsubscribe(conn connection, channel string, pattern bool) error {
 	if !h.hasConnection(conn) {
 		return errors.New("Unknown connection")
 	}
-	if !h.hasSubscription(conn, channel) {
+	if !h.hasSubscription(conn, channel, pattern) {
 		// Some clients seem to be sending double unsubscribes,
 		// ignore those for now:
 		//return fmt.Errorf("Not subscribed to channel %s", channel)
@@ -172,73 +361,238 @@ func (h *hub) Unsubscribe(conn connection, channel string) error {
 	r := subscriptionRequest{
 		Connection: conn,
 		Channel:    channel,
-		Done:       make(chan error),
+		Pattern:    pattern,
+		Done:       make(chan error, 1),
 	}
-	h.newUnsubscriptions <- r
-	return <-r.Done
+	return h.request(h.shard(channel).newUnsubscriptions, r)
 }
 
-func (h *hub) handleUnsubscribe(r subscriptionRequest) {
-	h.Lock()
-	defer h.Unlock()
+func (s *hubShard) handleUnsubscribe(r subscriptionRequest) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.hub.Lock()
+	delete(s.hub.subscriptions[r.Connection], subscription{r.Channel, r.Pattern})
+	s.hub.Unlock()
 
-	delete(h.subscriptions[r.Connection], r.Channel)
-	delete(h.channels[r.Channel], r.Connection)
+	subscribers := s.subscribers(r.Pattern)
+	delete(subscribers[r.Channel], r.Connection)
 
-	if len(h.channels[r.Channel]) == 0 {
+	if len(subscribers[r.Channel]) == 0 {
 		// Last subscriber, release it.
-		h.redis.Unsubscribe(r.Channel)
-		delete(h.channels, r.Channel)
+		if r.Pattern {
+			s.hub.backend.PUnsubscribe(r.Channel)
+		} else {
+			s.hub.backend.Unsubscribe(r.Channel)
+		}
+		delete(subscribers, r.Channel)
 	}
 
 	r.Done <- nil
 }
 
 func (h *hub) processClient(t, token string, args []string) {
-	if c, ok := h.connections[token]; ok {
+	h.Lock()
+	defer h.Unlock()
+
+	for c, _ := range h.connections[token] {
 		c.Process(t, args)
 	}
 }
 
-func (h *hub) handleMessage(m redis.Message) {
-	h.Lock()
-	defer h.Unlock()
-
-	if m.Channel == h.redis.controlChannel {
+// Handles client control messages, passes everything else to the shard that
+// owns the channel.
+func (h *hub) handleMessage(m BackendMessage) {
+	if m.Control {
 		args := strings.Split(string(m.Data), " ")
 		switch args[0] {
-		case "transfer":
-			h.processClient(args[0], args[1], args[2:])
-		case "subscribe":
-			h.processClient(args[0], args[1], args[2:])
-		case "unsubscribe":
+		case "transfer", "subscribe", "unsubscribe", "psubscribe", "punsubscribe":
 			h.processClient(args[0], args[1], args[2:])
+		case "notify":
+			h.shard(args[1]).push(m)
 		}
-	} else {
-		if _, ok := h.channels[m.Channel]; !ok {
-			return // No longer subscribed?
+		return
+	}
+
+	key := m.Channel
+	if m.Pattern != "" {
+		key = m.Pattern
+	}
+	h.shard(key).push(m)
+}
+
+func (s *hubShard) push(m BackendMessage) {
+	select {
+	case s.messages <- m:
+	case <-s.hub.quit:
+	}
+}
+
+func (s *hubShard) handleMessage(m BackendMessage) {
+	s.Lock()
+	defer s.Unlock()
+
+	if m.Control {
+		args := strings.Split(string(m.Data), " ")
+		s.notify(args[1], strings.Join(args[2:], " "))
+		return
+	}
+
+	key := m.Channel
+	if m.Pattern != "" {
+		key = m.Pattern
+	}
+	subscribers, ok := s.subscribers(m.Pattern != "")[key]
+	if !ok {
+		return // No longer subscribed?
+	}
+
+	msg := Message{
+		Channel: m.Channel,
+		Pattern: m.Pattern,
+		Body:    string(m.Data),
+		ID:      m.ID,
+		Time:    m.Time,
+	}
+	s.fanOut(subscribers, func(conn connection) {
+		conn.Send(msg)
+	})
+	s.relayed += int64(len(subscribers))
+}
+
+// Sends a notification to all local subscribers of a channel
+func (s *hubShard) notify(channel, data string) {
+	m := ClientMessage{}
+	err := json.Unmarshal([]byte(data), &m)
+	if err != nil {
+		return
+	}
+
+	s.fanOut(s.channels[channel], func(conn connection) {
+		conn.Notify(m)
+	})
+}
+
+// Calls fn for each subscriber, splits large sets over multiple goroutines.
+// Lock must be held.
+func (s *hubShard) fanOut(subscribers map[connection]bool, fn func(conn connection)) {
+	workers := runtime.GOMAXPROCS(0)
+	if len(subscribers) < parallelFanOut || workers == 1 {
+		for conn, _ := range subscribers {
+			fn(conn)
+		}
+		return
+	}
+
+	conns := make([]connection, 0, len(subscribers))
+	for conn, _ := range subscribers {
+		conns = append(conns, conn)
+	}
+
+	size := (len(conns) + workers - 1) / workers
+	var wg sync.WaitGroup
+	for start := 0; start < len(conns); start += size {
+		end := start + size
+		if end > len(conns) {
+			end = len(conns)
 		}
+		wg.Add(1)
+		go func(conns []connection) {
+			defer wg.Done()
+			for _, conn := range conns {
+				fn(conn)
+			}
+		}(conns[start:end])
+	}
+	wg.Wait()
+}
 
-		for conn, _ := range h.channels[m.Channel] {
-			conn.Send(m.Channel, string(m.Data))
+// Tokens of the local subscribers, by channel.
+func (h *hub) channelTokens() map[string][]string {
+	h.Lock()
+	defer h.Unlock()
+
+	result := make(map[string][]string)
+	for conn, subscriptions := range h.subscriptions {
+		for s, _ := range subscriptions {
+			if !s.Pattern {
+				result[s.Channel] = append(result[s.Channel], conn.GetToken())
+			}
 		}
 	}
+	return result
+}
+
+// Sends a message to the connections of a token that are subscribed to it.
+func (h *hub) deliver(token string, m Message) {
+	key := subscription{m.Channel, false}
+	if m.Pattern != "" {
+		key = subscription{m.Pattern, true}
+	}
+
+	h.Lock()
+	conns := make([]connection, 0)
+	for conn, _ := range h.connections[token] {
+		if h.subscriptions[conn][key] {
+			conns = append(conns, conn)
+		}
+	}
+	h.Unlock()
+
+	for _, conn := range conns {
+		conn.Send(m)
+	}
 }
 
 type hubStats struct {
 	LocalSubscriptions map[string]int
+	LocalPatterns      map[string]int
+	Connections        map[string]int
+	MessagesRelayed    int64
+}
+
+// Number of distinct sessions among the connections.
+func countSessions(conns map[connection]bool) int {
+	tokens := make(map[string]bool)
+	for conn, _ := range conns {
+		tokens[conn.GetToken()] = true
+	}
+	return len(tokens)
 }
 
 func (h *hub) Stats() (hubStats, error) {
+	subscriptions := make(map[string]int)
+	patterns := make(map[string]int)
+	relayed := int64(0)
+	for _, shard := range h.shards {
+		shard.Lock()
+		for k, v := range shard.channels {
+			subscriptions[k] = countSessions(v)
+		}
+		for k, v := range shard.patterns {
+			patterns[k] = countSessions(v)
+		}
+		relayed += shard.relayed
+		shard.Unlock()
+	}
+
 	h.Lock()
 	defer h.Unlock()
 
-	subscriptions := make(map[string]int)
-	for k, v := range h.channels {
-		subscriptions[k] = len(v)
+	// Counts sessions: a long-poll session has a connection for the
+	// running poll and one that listens in between polls.
+	connections := make(map[string]int)
+	for _, conns := range h.connections {
+		for conn, _ := range conns {
+			connections[conn.GetTransport()]++
+			break
+		}
 	}
 
 	return hubStats{
 		LocalSubscriptions: subscriptions,
+		LocalPatterns:      patterns,
+		Connections:        connections,
+		MessagesRelayed:    relayed,
 	}, nil
 }
@@ -1,34 +1,60 @@
 package broadcaster
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
 
 var testChannel = "test"
 
-var hubTestBackend *redisBackend
+var hubTestBackend Backend
 var hubTestRedis *testRedis
 
 type testConnection struct {
 	Messages chan string
 }
 
-func (t *testConnection) Send(channel, message string) {
-	t.Messages <- fmt.Sprintf("%s - %s", channel, message)
+func (t *testConnection) Send(m Message) {
+	t.Messages <- fmt.Sprintf("%s - %s", m.Channel, m.Body)
+}
+
+func (t *testConnection) Notify(m ClientMessage) {
+	t.Messages <- fmt.Sprintf("%s - %s", m.Channel(), m.Type())
 }
 
 func (c *testConnection) Process(t string, args []string) {
 }
 
+func (c *testConnection) Shutdown() {
+}
+
 func (c *testConnection) GetToken() string {
 	return "test"
 }
 
+func (c *testConnection) GetTransport() string {
+	return "test"
+}
+
+func hubSendMessage(channel, message string) error {
+	if hubTestRedis != nil {
+		return hubTestRedis.sendMessage(channel, message)
+	}
+	return hubTestBackend.Publish(Message{
+		Channel: channel,
+		Body:    message,
+		Time:    time.Now(),
+	})
+}
+
 func TestHubConnectDisconnect(t *testing.T) {
 	hub := &hub{
-		redis: hubTestBackend,
+		backend: hubTestBackend,
 	}
 
 	err := hub.Prepare()
@@ -60,9 +86,97 @@ func TestHubConnectDisconnect(t *testing.T) {
 	}
 }
 
+func TestHubStopped(t *testing.T) {
+	hub := &hub{
+		backend: hubTestBackend,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+
+	conn := &testConnection{}
+	err = hub.Connect(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hub.Subscribe(conn, testChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub.Stop()
+
+	done := make(chan error, 1)
+	go func() {
+		err := hub.Subscribe(conn, "other")
+		if err == nil {
+			err = errors.New("Expected subscribe to fail")
+		} else {
+			err = hub.Disconnect(conn)
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Hub calls blocked after stop")
+	}
+
+	if len(hub.subscriptions) != 0 {
+		t.Errorf("Expected 0 connections, got %d", len(hub.subscriptions))
+	}
+}
+
+func TestHubStatsCountsSessions(t *testing.T) {
+	hub := &hub{
+		backend: hubTestBackend,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+	defer hub.Stop()
+
+	// Same session, like a long-poll client with a running poll and a
+	// listener in between polls.
+	for i := 0; i < 2; i++ {
+		conn := &testConnection{}
+		err = hub.Connect(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = hub.Subscribe(conn, testChannel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := hub.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Connections["test"] != 1 {
+		t.Errorf("Expected 1 connection, got %#v", stats.Connections)
+	}
+	if stats.LocalSubscriptions[testChannel] != 1 {
+		t.Errorf("Expected 1 subscriber, got %#v", stats.LocalSubscriptions)
+	}
+}
+
 func TestHubSubscribe(t *testing.T) {
 	hub := &hub{
-		redis: hubTestBackend,
+		backend: hubTestBackend,
 	}
 
 	err := hub.Prepare()
@@ -95,7 +209,7 @@ func TestHubSubscribe(t *testing.T) {
 
 func TestHubUnsubscribe(t *testing.T) {
 	hub := &hub{
-		redis: hubTestBackend,
+		backend: hubTestBackend,
 	}
 
 	err := hub.Prepare()
@@ -157,7 +271,7 @@ func TestHubUnsubscribe(t *testing.T) {
 
 func TestHubMessage(t *testing.T) {
 	hub := &hub{
-		redis: hubTestBackend,
+		backend: hubTestBackend,
 	}
 
 	err := hub.Prepare()
@@ -177,7 +291,7 @@ func TestHubMessage(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	hubTestRedis.sendMessage(testChannel, "1")
+	hubSendMessage(testChannel, "1")
 	select {
 	case <-conn.Messages:
 		t.Errorf("Shouldn't have received a message!")
@@ -191,10 +305,163 @@ func TestHubMessage(t *testing.T) {
 
 	time.Sleep(1 * time.Second)
 
-	hubTestRedis.sendMessage(testChannel, "1")
+	hubSendMessage(testChannel, "1")
 	select {
 	case <-conn.Messages:
 	case <-time.After(1 * time.Second):
 		t.Errorf("Should have received a message!")
 	}
 }
+
+func TestHubShards(t *testing.T) {
+	hub := &hub{
+		backend:    hubTestBackend,
+		shardCount: 4,
+	}
+
+	err := hub.Prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go hub.Run()
+	defer hub.Stop()
+
+	conn := &testConnection{
+		Messages: make(chan string, 10),
+	}
+
+	err = hub.Connect(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channels := []string{"shard-1", "shard-2", "shard-3", "shard-4", "shard-5"}
+	for _, channel := range channels {
+		err = hub.Subscribe(conn, channel)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := hub.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.LocalSubscriptions) != len(channels) {
+		t.Errorf("Expected %d channels, got %d", len(channels), len(stats.LocalSubscriptions))
+	}
+
+	time.Sleep(1 * time.Second)
+
+	received := make(map[string]bool)
+	for _, channel := range channels {
+		hubSendMessage(channel, "1")
+	}
+	for range channels {
+		select {
+		case m := <-conn.Messages:
+			received[m] = true
+		case <-time.After(1 * time.Second):
+			t.Fatal("Should have received a message!")
+		}
+	}
+	for _, channel := range channels {
+		if !received[channel+" - 1"] {
+			t.Errorf("Missing message on %s", channel)
+		}
+	}
+
+	err = hub.Disconnect(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err = hub.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.LocalSubscriptions) != 0 {
+		t.Errorf("Expected 0 channels, got %d", len(stats.LocalSubscriptions))
+	}
+}
+
+type benchConnection struct {
+	wg *sync.WaitGroup
+}
+
+func (c *benchConnection) Send(m Message) {
+	json.Marshal(newBroadcastMessage(m))
+	c.wg.Done()
+}
+
+func (c *benchConnection) Notify(m ClientMessage) {
+}
+
+func (c *benchConnection) Process(t string, args []string) {
+}
+
+func (c *benchConnection) Shutdown() {
+}
+
+func (c *benchConnection) GetToken() string {
+	return "bench"
+}
+
+func (c *benchConnection) GetTransport() string {
+	return "bench"
+}
+
+// Relays b.N messages, spread over the given number of channels. Messages
+// are handed to the hub directly, to leave the backend out of it. Run with
+// -cpu 1,2,4,... to see it scale: the hub uses a worker per CPU.
+func benchmarkHub(b *testing.B, channels, subscribers int) {
+	hub := &hub{
+		backend:    NewMemoryBackend(1 * time.Second),
+		shardCount: runtime.GOMAXPROCS(0),
+	}
+	err := hub.Prepare()
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, shard := range hub.shards {
+		go shard.Run()
+	}
+	defer hub.Stop()
+
+	var wg sync.WaitGroup
+	names := make([]string, channels)
+	for i := range names {
+		names[i] = fmt.Sprintf("bench-%d", i)
+		for j := 0; j < subscribers; j++ {
+			conn := &benchConnection{wg: &wg}
+			err := hub.Connect(conn)
+			if err != nil {
+				b.Fatal(err)
+			}
+			err = hub.Subscribe(conn, names[i])
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.ResetTimer()
+	wg.Add(b.N * subscribers)
+	for i := 0; i < b.N; i++ {
+		hub.handleMessage(BackendMessage{
+			Channel: names[i%channels],
+			Data:    []byte(`{"hello":"world"}`),
+			Time:    time.Now(),
+		})
+	}
+	wg.Wait()
+}
+
+func BenchmarkHubManyChannels(b *testing.B) {
+	benchmarkHub(b, 256, 10)
+}
+
+func BenchmarkHubFanOut(b *testing.B) {
+	benchmarkHub(b, 1, 10000)
+}
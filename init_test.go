@@ -1,6 +1,7 @@
 package broadcaster
 
 import (
+	"flag"
 	"fmt"
 	"math/rand"
 	"net"
@@ -25,10 +26,28 @@ type testRedis struct {
 
 var portSource = rand.New(rand.NewSource(26))
 
+// Backend used for tests: redis or memory. Defaults to redis when
+// redis-server is available.
+var testBackend = flag.String("backend", "", "Backend to test against (redis or memory)")
+
 func TestMain(m *testing.M) {
-	hubTestBackend, hubTestRedis = newTestRedisBackend()
+	flag.Parse()
+	if *testBackend == "" {
+		*testBackend = "memory"
+		if _, err := exec.LookPath("redis-server"); err == nil {
+			*testBackend = "redis"
+		}
+	}
+
+	if *testBackend == "redis" {
+		hubTestBackend, hubTestRedis = newTestRedisBackend()
+	} else {
+		hubTestBackend = NewMemoryBackend(1 * time.Second)
+	}
 	code := m.Run()
-	hubTestRedis.Stop()
+	if hubTestRedis != nil {
+		hubTestRedis.Stop()
+	}
 	os.Exit(code)
 }
 
@@ -123,9 +142,13 @@ type testServer struct {
 }
 
 func startServer(s *Server, port int) (*testServer, error) {
-	r, err := startRedis()
-	if err != nil {
-		return nil, err
+	var r *testRedis
+	if *testBackend == "redis" {
+		redis, err := startRedis()
+		if err != nil {
+			return nil, err
+		}
+		r = redis
 	}
 
 	if port == 0 {
@@ -137,7 +160,7 @@ func startServer(s *Server, port int) (*testServer, error) {
 		Broadcaster: s,
 		Redis:       r,
 	}
-	err = server.Start()
+	err := server.Start()
 	if err != nil {
 		return nil, err
 	}
@@ -154,8 +177,12 @@ func (s *testServer) Start() error {
 		s.Broadcaster = &Server{}
 	}
 
-	s.Broadcaster.RedisHost = fmt.Sprintf("localhost:%d", s.Redis.Port)
 	s.Broadcaster.Timeout = 1 * time.Second
+	if s.Redis != nil {
+		s.Broadcaster.RedisHost = fmt.Sprintf("localhost:%d", s.Redis.Port)
+	} else {
+		s.Broadcaster.Backend = NewMemoryBackend(s.Broadcaster.Timeout)
+	}
 	s.Broadcaster.PollTime = 100 * time.Millisecond
 
 	err = s.Broadcaster.Prepare()
@@ -176,14 +203,20 @@ func (s *testServer) Start() error {
 }
 
 func (s *testServer) Stop() {
-	s.Redis.Stop()
+	s.HTTPServer.Close()
+	if s.Redis != nil {
+		s.Redis.Stop()
+	}
 }
 
 func (s *testServer) sendMessage(channel, message string) error {
-	return s.Redis.sendMessage(channel, message)
+	if s.Redis != nil {
+		return s.Redis.sendMessage(channel, message)
+	}
+	return s.Broadcaster.Publish(channel, message)
 }
 
-func newTestRedisBackend() (*redisBackend, *testRedis) {
+func newTestRedisBackend() (Backend, *testRedis) {
 	s, err := startRedis()
 	if err != nil {
 		panic(err)
@@ -237,3 +270,24 @@ func newLPClient(s *testServer, conf ...func(c *Client)) (*Client, error) {
 
 	return client, nil
 }
+
+func newSSEClient(s *testServer, conf ...func(c *Client)) (*Client, error) {
+	url := fmt.Sprintf("http://localhost:%d/broadcaster/", s.Port)
+	client, err := NewClient(url)
+	if err != nil {
+		return nil, err
+	}
+	client.Mode = ClientModeSSE
+	client.UserAgent = "test"
+
+	for _, v := range conf {
+		v(client)
+	}
+
+	err = client.Connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
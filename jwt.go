@@ -0,0 +1,240 @@
+package broadcaster
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// JWTAuthenticator is an Authenticator that verifies JSON Web Tokens, signed
+// with HS256 or RS256, passed in the auth data. The subject becomes the user
+// id of the identity.
+//
+// The channels claim holds glob patterns (see PSubscribe for the syntax) of
+// the channels the client may subscribe to. It's used automatically unless
+// Server.AuthorizeSubscribe is set. Clients may subscribe to patterns that
+// only match channels they're allowed to, unless Server.AuthorizePSubscribe
+// is set.
+type JWTAuthenticator struct {
+	// Key for HS256 tokens
+	Secret []byte
+
+	// Key for RS256 tokens
+	PublicKey *rsa.PublicKey
+
+	// Expected issuer, not checked when empty
+	Issuer string
+
+	// Expected audience, not checked when empty
+	Audience string
+
+	// Allowed clock skew when checking exp and nbf
+	Leeway time.Duration
+
+	// Auth data field that holds the token, defaults to "token"
+	TokenField string
+
+	// Claim with the channels the client may subscribe to, defaults to
+	// "channels"
+	ChannelsClaim string
+
+	// Claim with the roles of the client, defaults to "roles"
+	RolesClaim string
+}
+
+// Implemented by authenticators that also decide on subscriptions, used
+// when Server.AuthorizeSubscribe is not set.
+type SubscribeAuthorizer interface {
+	CanSubscribe(identity *Identity, channel string) bool
+}
+
+// Implemented by authenticators that also decide on pattern subscriptions,
+// used when Server.AuthorizePSubscribe is not set.
+type PSubscribeAuthorizer interface {
+	CanPSubscribe(identity *Identity, pattern string) bool
+}
+
+func (a *JWTAuthenticator) Authenticate(data map[string]interface{}) (*Identity, error) {
+	field := a.TokenField
+	if field == "" {
+		field = "token"
+	}
+	token, _ := data[field].(string)
+	if token == "" {
+		return nil, errors.New("Missing token")
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	identity := &Identity{
+		Claims: claims,
+	}
+	identity.UserID, _ = claims["sub"].(string)
+	if exp, ok := claims["exp"]; ok {
+		t, ok := numericDate(exp)
+		if !ok {
+			return nil, errors.New("Invalid token")
+		}
+		identity.Expires = t.Add(a.Leeway)
+		if now.After(identity.Expires) {
+			return nil, errors.New("Token expired")
+		}
+	}
+	if nbf, ok := claims["nbf"]; ok {
+		t, ok := numericDate(nbf)
+		if !ok {
+			return nil, errors.New("Invalid token")
+		}
+		if now.Add(a.Leeway).Before(t) {
+			return nil, errors.New("Token not valid yet")
+		}
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, errors.New("Invalid issuer")
+	}
+	if a.Audience != "" && !containsClaim(claims["aud"], a.Audience) {
+		return nil, errors.New("Invalid audience")
+	}
+
+	roles := a.RolesClaim
+	if roles == "" {
+		roles = "roles"
+	}
+	identity.Roles = stringsClaim(claims[roles])
+	return identity, nil
+}
+
+// CanSubscribe checks the channel against the channels claim of the token.
+func (a *JWTAuthenticator) CanSubscribe(identity *Identity, channel string) bool {
+	for _, pattern := range a.channels(identity) {
+		if globMatch(pattern, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanPSubscribe checks that a pattern in the channels claim covers all
+// channels matched by the requested pattern.
+func (a *JWTAuthenticator) CanPSubscribe(identity *Identity, pattern string) bool {
+	for _, allowed := range a.channels(identity) {
+		if globContains(allowed, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *JWTAuthenticator) channels(identity *Identity) []string {
+	if identity == nil {
+		return nil
+	}
+
+	claim := a.ChannelsClaim
+	if claim == "" {
+		claim = "channels"
+	}
+	return stringsClaim(identity.Claims[claim])
+}
+
+// Checks the signature, returns the claims.
+func (a *JWTAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Invalid token")
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+	}{}
+	err := decodeJWTPart(parts[0], &header)
+	if err != nil {
+		return nil, errors.New("Invalid token")
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Invalid token")
+	}
+
+	// Only accept algorithms we have a key for
+	signed := []byte(parts[0] + "." + parts[1])
+	switch {
+	case header.Alg == "HS256" && a.Secret != nil:
+		mac := hmac.New(sha256.New, a.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return nil, errors.New("Invalid signature")
+		}
+	case header.Alg == "RS256" && a.PublicKey != nil:
+		hash := sha256.Sum256(signed)
+		err := rsa.VerifyPKCS1v15(a.PublicKey, crypto.SHA256, hash[:], signature)
+		if err != nil {
+			return nil, errors.New("Invalid signature")
+		}
+	default:
+		return nil, errors.New("Unsupported algorithm")
+	}
+
+	claims := make(map[string]interface{})
+	err = decodeJWTPart(parts[1], &claims)
+	if err != nil {
+		return nil, errors.New("Invalid token")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Seconds since the epoch
+func numericDate(v interface{}) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// Claims like aud can be a single string or a list of them.
+func stringsClaim(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []string:
+		return c
+	case []interface{}:
+		result := make([]string, 0, len(c))
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				result = append(result, s)
+			}
+		}
+		return result
+	}
+	return nil
+}
+
+func containsClaim(v interface{}, value string) bool {
+	for _, s := range stringsClaim(v) {
+		if s == value {
+			return true
+		}
+	}
+	return false
+}
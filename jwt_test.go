@@ -0,0 +1,193 @@
+package broadcaster
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+var jwtTestSecret = []byte("secret")
+
+func signTestJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	a := &JWTAuthenticator{
+		Secret:   jwtTestSecret,
+		Issuer:   "issuer",
+		Audience: "broadcaster",
+	}
+	now := time.Now().Unix()
+
+	tests := []struct {
+		claims map[string]interface{}
+		key    interface{}
+		err    string
+	}{
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "broadcaster", "exp": now + 60}, jwtTestSecret, ""},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": []string{"other", "broadcaster"}}, jwtTestSecret, ""},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "broadcaster"}, []byte("wrong"), "Invalid signature"},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "broadcaster", "exp": now - 60}, jwtTestSecret, "Token expired"},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "broadcaster", "nbf": now + 60}, jwtTestSecret, "Token not valid yet"},
+		{map[string]interface{}{"sub": "bob", "iss": "other", "aud": "broadcaster"}, jwtTestSecret, "Invalid issuer"},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "other"}, jwtTestSecret, "Invalid audience"},
+		{map[string]interface{}{"sub": "bob", "iss": "issuer", "aud": "broadcaster", "exp": "never"}, jwtTestSecret, "Invalid token"},
+	}
+
+	for _, test := range tests {
+		token := signTestJWT(t, "HS256", test.key, test.claims)
+		identity, err := a.Authenticate(map[string]interface{}{"token": token})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("Expected %#v for %#v, got %v", test.err, test.claims, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %#v: %s", test.claims, err)
+			continue
+		}
+		if identity.UserID != "bob" {
+			t.Errorf("Unexpected user: %#v", identity.UserID)
+		}
+	}
+
+	// Leeway
+	a.Leeway = time.Minute
+	token := signTestJWT(t, "HS256", jwtTestSecret, map[string]interface{}{"iss": "issuer", "aud": "broadcaster", "exp": now - 10})
+	_, err := a.Authenticate(map[string]interface{}{"token": token})
+	if err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	invalid := []string{
+		"",
+		"abc",
+		"a.b.c",
+		signTestJWT(t, "none", nil, map[string]interface{}{"sub": "bob"}),
+		signTestJWT(t, "RS256", jwtTestSecret, map[string]interface{}{"sub": "bob"}),
+	}
+	for _, token := range invalid {
+		_, err := a.Authenticate(map[string]interface{}{"token": token})
+		if err == nil {
+			t.Errorf("Expected error for %#v", token)
+		}
+	}
+}
+
+func TestJWTAuthenticatorRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &JWTAuthenticator{
+		PublicKey: &key.PublicKey,
+	}
+	claims := map[string]interface{}{"sub": "bob", "roles": []string{"admin"}}
+
+	identity, err := a.Authenticate(map[string]interface{}{"token": signTestJWT(t, "RS256", key, claims)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.UserID != "bob" || !identity.HasRole("admin") {
+		t.Errorf("Unexpected identity: %#v", identity)
+	}
+
+	_, err = a.Authenticate(map[string]interface{}{"token": signTestJWT(t, "RS256", other, claims)})
+	if err == nil || err.Error() != "Invalid signature" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// No secret configured, HS256 tokens signed with anything (such as
+	// the public key) are refused.
+	_, err = a.Authenticate(map[string]interface{}{"token": signTestJWT(t, "HS256", []byte("key"), claims)})
+	if err == nil || err.Error() != "Unsupported algorithm" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestJWTServer(t *testing.T) {
+	server, err := startServer(&Server{
+		Authenticator: &JWTAuthenticator{
+			Secret: jwtTestSecret,
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	token := signTestJWT(t, "HS256", jwtTestSecret, map[string]interface{}{
+		"sub":      "bob",
+		"channels": []string{"news.*", "user.bob", "rooms.?"},
+	})
+	client, err := newWSClient(server, func(c *Client) {
+		c.AuthData = map[string]interface{}{"token": token}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	for _, channel := range []string{"news.sports", "user.bob"} {
+		err = client.Subscribe(channel)
+		if err != nil {
+			t.Errorf("Subscribe to %s failed: %s", channel, err)
+		}
+	}
+	for _, channel := range []string{"news", "user.alice"} {
+		err = client.Subscribe(channel)
+		if err == nil {
+			t.Errorf("Expected subscribe to %s to be refused", channel)
+		}
+	}
+
+	// Patterns have to be covered by the claim
+	for _, pattern := range []string{"news.s*", "rooms.?", "user.bob"} {
+		err = client.PSubscribe(pattern)
+		if err != nil {
+			t.Errorf("PSubscribe to %s failed: %s", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"rooms.*", "user.*", "*"} {
+		err = client.PSubscribe(pattern)
+		if err == nil {
+			t.Errorf("Expected psubscribe to %s to be refused", pattern)
+		}
+	}
+}
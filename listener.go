@@ -0,0 +1,309 @@
+package broadcaster
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Request based connection (long-poll and event streams). Receives messages
+// and subscription changes from the hub, hands them to the request that's
+// listening and backlogs them in between requests.
+type pollListener struct {
+	server *Server
+	token  string
+	conn   connection
+
+	messages chan ClientMessage
+	queue    *sendQueue
+	shutdown chan struct{}
+	closing  bool
+
+	// Stops listening when it fires
+	deadline <-chan time.Time
+
+	// Calls onKeepAlive when it fires, if set
+	keepAlive   <-chan time.Time
+	onKeepAlive func() error
+
+	control  *controlQueue
+	transfer chan string
+}
+
+// Registers the connection and subscribes it to the channels and patterns of
+// the session. Returns the channels.
+func (l *pollListener) start(s *Server, token string, conn connection) ([]string, error) {
+	l.server = s
+	l.token = token
+	l.conn = conn
+
+	backend := s.Backend
+	err := backend.LongpollPing(token)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only needed for storing pending messages
+	resume := ""
+	if s.RequireAck != nil {
+		resume, err = s.resumeKey(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l.messages = make(chan ClientMessage, 10)
+	l.control = newControlQueue()
+	l.transfer = make(chan string, 10)
+	l.shutdown = make(chan struct{}, 1)
+	l.queue = newSendQueue(s, token, resume, l.enqueue, l.Shutdown)
+
+	err = s.register(conn)
+	if err != nil {
+		l.queue.stop()
+		return nil, err
+	}
+
+	channels, err := l.resubscribe()
+	if err != nil {
+		l.disconnect()
+		s.active.Done()
+		return nil, err
+	}
+	return channels, nil
+}
+
+// Subscribes to all the channels and patterns that are tracked for the
+// session.
+func (l *pollListener) resubscribe() ([]string, error) {
+	backend := l.server.Backend
+	hub := l.server.hub
+
+	channels, err := backend.LongpollGetChannels(l.token)
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		err := hub.Subscribe(l.conn, channel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	patterns, err := backend.LongpollGetPatterns(l.token)
+	if err != nil {
+		return nil, err
+	}
+	for _, pattern := range patterns {
+		err := hub.PSubscribe(l.conn, pattern)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return channels, nil
+}
+
+// Passes messages to onMessage until the connection gets transferred (returns
+// true), done is closed, onMessage fails or the deadline hits.
+func (l *pollListener) listen(seq string, done <-chan struct{}, onMessage func(m ClientMessage) error) bool {
+	hub := l.server.hub
+
+	for {
+		select {
+		case <-done:
+			return false
+		case <-l.deadline:
+			return false
+		case <-l.keepAlive:
+			err := l.onKeepAlive()
+			if err != nil {
+				return false
+			}
+		case <-l.shutdown:
+			l.closing = true
+			return false
+		case <-l.control.ready:
+			l.control.apply(hub, l.conn)
+		case s := <-l.transfer:
+			if s != seq {
+				return true
+			}
+		case m := <-l.messages:
+			err := onMessage(m)
+			if err != nil {
+				return false
+			}
+		}
+	}
+}
+
+// Cleans up once the request is done. Unless the session moved elsewhere,
+// keeps listening in the background until the client comes back.
+func (l *pollListener) finish(seq string, transferred bool) {
+	if transferred {
+		l.handOver()
+		l.server.active.Done()
+		return
+	}
+	if l.closing {
+		l.close()
+		return
+	}
+	go l.linger(seq)
+}
+
+// Backlogs messages until a new request comes in. This ensures the client
+// doesn't lose any messages.
+func (l *pollListener) linger(seq string) {
+	backend := l.server.Backend
+	hub := l.server.hub
+
+	l.deadline = time.After(l.server.Timeout)
+	l.keepAlive = nil
+	backlog := int64(0)
+	transferred := l.listen(seq, nil, func(m ClientMessage) error {
+		l.server.metrics.backlogged.Inc()
+		l.server.metrics.backlog.Inc()
+		backlog++
+		backend.LongpollBacklog(l.token, m)
+		return nil
+	})
+
+	// Picked up by the next request, or expired
+	l.server.metrics.backlog.Sub(backlog)
+	if l.closing {
+		l.close()
+		return
+	}
+	if !transferred && !hub.hasOtherConnections(l.conn) {
+		// Client didn't come back in time
+		for _, channel := range hub.connectionChannels(l.conn) {
+			l.server.leave(l.token, channel)
+		}
+	}
+	l.handOver()
+	l.server.active.Done()
+}
+
+// Removes the session when shutting down, the client will reconnect to a
+// different node.
+func (l *pollListener) close() {
+	hub := l.server.hub
+	for _, channel := range hub.connectionChannels(l.conn) {
+		l.server.leave(l.token, channel)
+	}
+	l.server.Backend.DeleteSession(l.token)
+	l.disconnect()
+	l.server.active.Done()
+}
+
+// Removes the connection from the hub and stops its send queue.
+func (l *pollListener) disconnect() {
+	l.server.hub.Disconnect(l.conn)
+	l.queue.stop()
+}
+
+// Disconnects and backlogs the messages that weren't passed on yet, for the
+// next request.
+func (l *pollListener) handOver() {
+	l.server.hub.Disconnect(l.conn)
+
+	backlog := make([]ClientMessage, 0)
+	queued := l.queue.drain()
+	for done := false; !done; {
+		select {
+		case m := <-l.messages:
+			backlog = append(backlog, m)
+		default:
+			done = true
+		}
+	}
+	backlog = append(backlog, queued...)
+
+	for _, m := range backlog {
+		l.server.metrics.backlogged.Inc()
+		l.server.Backend.LongpollBacklog(l.token, m)
+	}
+}
+
+// Writer of the send queue, hands messages to listen.
+func (l *pollListener) enqueue(m ClientMessage) error {
+	select {
+	case l.messages <- m:
+		return nil
+	case <-l.queue.quit:
+		return errors.New("Connection closed")
+	}
+}
+
+func (l *pollListener) Send(m Message) {
+	l.queue.Send(m)
+}
+
+func (l *pollListener) Notify(m ClientMessage) {
+	l.queue.Notify(m)
+}
+
+func (l *pollListener) Shutdown() {
+	select {
+	case l.shutdown <- struct{}{}:
+	default: // Already shutting down
+	}
+}
+
+func (l *pollListener) Process(t string, args []string) {
+	switch t {
+	case "transfer":
+		select {
+		case l.transfer <- args[0]:
+		default: // Receiver might be dead and buffer is full, discard
+		}
+	case "subscribe", "unsubscribe", "psubscribe", "punsubscribe":
+		l.control.push(t, args[0])
+	}
+}
+
+// Subscription changes made through other nodes, applied by the listener.
+// Pushing never blocks: the hub calls it with its lock held, while applying
+// needs the hub.
+type controlQueue struct {
+	sync.Mutex
+	commands [][2]string
+	ready    chan struct{}
+}
+
+func newControlQueue() *controlQueue {
+	return &controlQueue{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *controlQueue) push(t, arg string) {
+	q.Lock()
+	q.commands = append(q.commands, [2]string{t, arg})
+	q.Unlock()
+
+	select {
+	case q.ready <- struct{}{}:
+	default: // Already signalled
+	}
+}
+
+func (q *controlQueue) apply(hub *hub, conn connection) {
+	q.Lock()
+	commands := q.commands
+	q.commands = nil
+	q.Unlock()
+
+	for _, cmd := range commands {
+		switch cmd[0] {
+		case "subscribe":
+			hub.Subscribe(conn, cmd[1])
+		case "unsubscribe":
+			hub.Unsubscribe(conn, cmd[1])
+		case "psubscribe":
+			hub.PSubscribe(conn, cmd[1])
+		case "punsubscribe":
+			hub.PUnsubscribe(conn, cmd[1])
+		}
+	}
+}
@@ -2,7 +2,9 @@ package broadcaster
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -16,29 +18,33 @@ import (
 )
 
 type longpollConnection struct {
+	pollListener
+
 	Token    string
 	Server   *Server
 	AuthData ClientMessage
 
-	combining bool
-	messages  chan ClientMessage
-	deadline  <-chan time.Time
+	// Used for replies, based on the request
+	codec Codec
 
-	subscribe   chan string
-	unsubscribe chan string
-	transfer    chan string
+	combining bool
 }
 
 func handleLongpollConnection(w http.ResponseWriter, r *http.Request, s *Server) error {
+	codec := s.requestCodec(r)
 	m := ClientMessage{}
-	json.NewDecoder(r.Body).Decode(&m)
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, s.MaxMessageSize))
+	if err != nil {
+		return err
+	}
+	codec.Unmarshal(body, &m)
 
-	redis := s.redis
+	backend := s.Backend
 
 	token := m.Token()
 	connected := false
 	if m.Token() != "" {
-		c, err := redis.IsConnected(token)
+		c, err := backend.IsConnected(token)
 		if err != nil {
 			return err
 		}
@@ -50,14 +56,26 @@ func handleLongpollConnection(w http.ResponseWriter, r *http.Request, s *Server)
 			Server:   s,
 			Token:    uuid.New(),
 			AuthData: m,
+			codec:    codec,
 		}
 		return conn.handshake(w, r, m)
 	}
 
+	expired, err := s.expireSession(token)
+	if err != nil {
+		return err
+	}
+	if expired {
+		w.WriteHeader(401)
+		longpollReply(w, codec, newErrorMessage(AuthFailedMessage, errors.New("Session expired")))
+		return nil
+	}
+
 	// Existing connection
 	conn := &longpollConnection{
 		Server: s,
 		Token:  m.Token(),
+		codec:  codec,
 	}
 
 	if m.Type() == PollMessage {
@@ -65,110 +83,261 @@ func handleLongpollConnection(w http.ResponseWriter, r *http.Request, s *Server)
 	} else {
 		switch m.Type() {
 		case SubscribeMessage:
-			auth, err := redis.GetSession(m.Token())
+			auth, identity, err := s.session(m.Token())
 			if err != nil {
 				return err
 			}
 
 			channel := m.Channel()
-			if s.CanSubscribe != nil && !s.CanSubscribe(auth, channel) {
-				longpollReply(w, ClientMessage{
-					"__type":  SubscribeErrorMessage,
-					"channel": channel,
-					"reason":  "Channel refused",
-				})
+			replay, err := conn.subscribeChannel(identity, auth, m)
+			if err != nil {
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
 				return nil
 			}
 
-			err = redis.LongpollSubscribe(m.Token(), channel)
+			longpollResult(w, conn.codec, m, newSubscribeOKMessage(channel, replay), replay...)
+
+		case SubscribeManyMessage:
+			auth, identity, err := s.session(m.Token())
 			if err != nil {
-				longpollReply(w, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
+				return err
+			}
+			if results := refuseBatch(m, SubscribeErrorMessage); results != nil {
+				longpollResult(w, conn.codec, m, newBatchMessage(SubscribeManyResultMessage, m, results))
 				return nil
 			}
 
-			longpollReply(w, newChannelMessage(SubscribeOKMessage, channel))
+			results := make([]ClientMessage, 0)
+			replay := make([]ClientMessage, 0)
+			for _, entry := range m.Channels() {
+				channel := entry.Channel()
+				r, err := conn.subscribeChannel(identity, auth, entry)
+				if err != nil {
+					results = append(results, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
+					continue
+				}
+				results = append(results, newSubscribeOKMessage(channel, r))
+				replay = append(replay, r...)
+			}
+
+			longpollResult(w, conn.codec, m, newBatchMessage(SubscribeManyResultMessage, m, results), replay...)
 
 		case UnsubscribeMessage:
 			channel := m.Channel()
-			err := redis.LongpollUnsubscribe(m.Token(), channel)
+			err := conn.unsubscribeChannel(channel)
 			if err != nil {
-				longpollReply(w, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+				return nil
+			}
+
+			longpollResult(w, conn.codec, m, newChannelMessage(UnsubscribeOKMessage, channel))
+
+		case UnsubscribeManyMessage:
+			if results := refuseBatch(m, UnsubscribeErrorMessage); results != nil {
+				longpollResult(w, conn.codec, m, newBatchMessage(UnsubscribeManyResultMessage, m, results))
 				return nil
 			}
+			results := make([]ClientMessage, 0)
+			for _, entry := range m.Channels() {
+				channel := entry.Channel()
+				err := conn.unsubscribeChannel(channel)
+				if err != nil {
+					results = append(results, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+					continue
+				}
+				results = append(results, newChannelMessage(UnsubscribeOKMessage, channel))
+			}
 
-			longpollReply(w, newChannelMessage(UnsubscribeOKMessage, channel))
+			longpollResult(w, conn.codec, m, newBatchMessage(UnsubscribeManyResultMessage, m, results))
+
+		case PSubscribeMessage:
+			auth, identity, err := s.session(m.Token())
+			if err != nil {
+				return err
+			}
+
+			pattern := m.Channel()
+			if !s.canPSubscribe(identity, auth, pattern) {
+				s.metrics.subscribeFailures.Inc()
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(PSubscribeErrorMessage, pattern, errors.New("Channel refused")))
+				return nil
+			}
+
+			err = backend.LongpollPSubscribe(m.Token(), pattern)
+			if err != nil {
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(PSubscribeErrorMessage, pattern, err))
+				return nil
+			}
+
+			s.metrics.subscribes.Inc()
+			longpollResult(w, conn.codec, m, newChannelMessage(PSubscribeOKMessage, pattern))
+
+		case PUnsubscribeMessage:
+			pattern := m.Channel()
+			err := backend.LongpollPUnsubscribe(m.Token(), pattern)
+			if err != nil {
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(PUnsubscribeErrorMessage, pattern, err))
+				return nil
+			}
+
+			s.metrics.unsubscribes.Inc()
+			longpollResult(w, conn.codec, m, newChannelMessage(PUnsubscribeOKMessage, pattern))
+
+		case PublishMessage:
+			auth, identity, err := s.session(m.Token())
+			if err != nil {
+				return err
+			}
+
+			channel := m.Channel()
+			err = s.clientPublish(identity, auth, channel, m.Body())
+			if err != nil {
+				longpollResult(w, conn.codec, m, newChannelErrorMessage(PublishErrorMessage, channel, err))
+				return nil
+			}
+
+			longpollResult(w, conn.codec, m, newChannelMessage(PublishOKMessage, channel))
+
+		case ReauthMessage:
+			_, identity, err := s.session(m.Token())
+			if err != nil {
+				return err
+			}
+
+			identity, err = s.reauthenticate(identity, m)
+			if err != nil {
+				s.metrics.connectFailures.Inc()
+				longpollResult(w, conn.codec, m, newErrorMessage(ReauthErrorMessage, err))
+				return nil
+			}
+			resume, err := s.resumeKey(m.Token())
+			if err != nil {
+				return err
+			}
+			err = backend.UpdateSession(m.Token(), sessionData(m, identity, resume))
+			if err != nil {
+				longpollResult(w, conn.codec, m, newErrorMessage(ReauthErrorMessage, err))
+				return nil
+			}
+
+			longpollResult(w, conn.codec, m, withExpiry(newMessage(ReauthOKMessage), identity))
+
+		case AckMessage:
+			resume, err := s.resumeKey(m.Token())
+			if err != nil {
+				return err
+			}
+			err = s.ack(resume, m)
+			if err != nil {
+				return err
+			}
+			longpollReply(w, conn.codec)
 
 		default:
-			longpollReply(w, newMessage(UnknownMessage))
+			longpollResult(w, conn.codec, m, newMessage(UnknownMessage))
 		}
 	}
 
 	return nil
 }
 
+// Subscribes to a channel, returns the messages that should be replayed.
+func (c *longpollConnection) subscribeChannel(identity *Identity, auth, m ClientMessage) ([]ClientMessage, error) {
+	s := c.Server
+	backend := s.Backend
+
+	channel := m.Channel()
+	if !s.verifyChannel(identity, m) && !s.canSubscribe(identity, auth, channel) {
+		s.metrics.subscribeFailures.Inc()
+		return nil, errors.New("Channel refused")
+	}
+
+	err := backend.LongpollSubscribe(c.Token, channel)
+	if err != nil {
+		return nil, err
+	}
+
+	replay, err := s.history(channel, m)
+	if err == nil {
+		err = s.join(auth, c.Token, channel)
+	}
+	if _, ok := m["resume"]; ok && err == nil {
+		var resume string
+		var pending []ClientMessage
+		resume, err = s.resumeKey(c.Token)
+		if err == nil {
+			pending, err = s.resume(resume, channel, m)
+			replay = mergeReplay(replay, pending)
+		}
+	}
+	if err != nil {
+		backend.LongpollUnsubscribe(c.Token, channel)
+		return nil, err
+	}
+
+	s.metrics.subscribes.Inc()
+	return replay, nil
+}
+
+func (c *longpollConnection) unsubscribeChannel(channel string) error {
+	err := c.Server.Backend.LongpollUnsubscribe(c.Token, channel)
+	if err == nil {
+		err = c.Server.leave(c.Token, channel)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Server.metrics.unsubscribes.Inc()
+	return nil
+}
+
 func (c *longpollConnection) handshake(w http.ResponseWriter, r *http.Request, auth ClientMessage) error {
 	// Expect auth packet first.
 	if auth.Type() != AuthMessage {
 		w.WriteHeader(401)
-		longpollReply(w, ClientMessage{"__type": AuthFailedMessage, "reason": "Auth expected"})
+		longpollReply(w, c.codec, ClientMessage{"__type": AuthFailedMessage, "reason": "Auth expected"})
 		return nil
 	}
 
-	if c.Server.CanConnect != nil && !c.Server.CanConnect(auth) {
+	identity, err := c.Server.authenticate(auth)
+	if err != nil {
+		c.Server.metrics.connectFailures.Inc()
 		w.WriteHeader(401)
-		longpollReply(w, ClientMessage{"__type": AuthFailedMessage, "reason": "Unauthorized"})
+		longpollReply(w, c.codec, newErrorMessage(AuthFailedMessage, err))
 		return nil
 	}
 
 	// Store session
-	err := c.Server.redis.StoreSession(c.Token, auth)
+	resume := uuid.New()
+	err = c.Server.Backend.StoreSession(c.Token, sessionData(auth, identity, resume))
 	if err != nil {
 		return err
 	}
 
-	longpollReply(w, ClientMessage{"__type": AuthOKMessage, "__token": c.Token})
+	reply := withExpiry(ClientMessage{"__type": AuthOKMessage, "__token": c.Token, resumeKey: resume}, identity)
+	if name := auth.Codec(); name != "" {
+		reply["__codec"] = c.Server.codec(name).Name()
+	}
+	longpollReply(w, c.codec, reply)
 
 	return nil
 }
 
 func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
-	redis := c.Server.redis
-	err := redis.LongpollPing(c.Token)
-	if err != nil {
-		return err
-	}
-
 	c.deadline = time.After(c.Server.Timeout - c.Server.PollTime)
-	c.messages = make(chan ClientMessage, 10)
-	c.subscribe = make(chan string, 10)
-	c.unsubscribe = make(chan string, 10)
-	c.transfer = make(chan string, 10)
-
-	hub := c.Server.hub
-
-	err = hub.Connect(c)
+	_, err := c.start(c.Server, c.Token, c)
 	if err != nil {
 		return err
 	}
 
-	// Resubscribe to all the channels that are tracked by this connection.
-	channels, err := redis.LongpollGetChannels(c.Token)
-	if err != nil {
-		return err
-	}
-	for _, channel := range channels {
-		err := hub.Subscribe(c, channel)
-		if err != nil {
-			hub.Disconnect(c)
-			return err
-		}
-	}
+	backend := c.Server.Backend
 
 	// Kill other listeners
-	go redis.LongpollTransfer(c.Token, seq)
+	go backend.LongpollTransfer(c.Token, seq)
 
 	// Ensure we broadcast the backlog
-	go redis.LongpollGetBacklog(c.Token, c.messages)
+	go backend.LongpollGetBacklog(c.Token, c.messages)
 
 	// Wait until we either time-out or until the message deadline hits.
 	// The initial deadline is configured to the polling Timeout length.
@@ -177,123 +346,126 @@ func (c *longpollConnection) poll(w http.ResponseWriter, seq string) error {
 	// Also handles notifications of (un)subscription which may have happend
 	// while waiting.
 	messages := []ClientMessage{}
-	transferred := c.listen(seq, func(m ClientMessage) {
+	transferred := c.listen(seq, nil, func(m ClientMessage) error {
 		if !c.combining {
 			c.deadline = time.After(c.Server.PollTime)
 			c.combining = true
 		}
 		messages = append(messages, m)
-	})
-	longpollReply(w, messages...)
-
-	if transferred {
-		hub.Disconnect(c)
 		return nil
+	})
+	if c.closing {
+		messages = append(messages, newMessage(ReconnectMessage))
 	}
+	longpollReply(w, c.codec, messages...)
 
-	go func() {
-		// Listens for new messages until a new client connects. This ensures we
-		// don't lose any messages
-		c.deadline = time.After(c.Server.Timeout)
-		c.listen(seq, func(m ClientMessage) {
-			redis.LongpollBacklog(c.Token, m)
-		})
-		hub.Disconnect(c)
-	}()
-
+	c.finish(seq, transferred)
 	return nil
 }
 
-func (c *longpollConnection) listen(seq string, onMessage func(m ClientMessage)) bool {
-	hub := c.Server.hub
-
-	for {
-		select {
-		case <-c.deadline:
-			return false
-		case channel := <-c.subscribe:
-			hub.Subscribe(c, channel)
-		case channel := <-c.unsubscribe:
-			hub.Unsubscribe(c, channel)
-		case s := <-c.transfer:
-			if s != seq {
-				return true
-			}
-		case m := <-c.messages:
-			onMessage(m)
-		}
+func longpollReply(w http.ResponseWriter, codec Codec, m ...ClientMessage) {
+	if isTextCodec(codec) {
+		json.NewEncoder(w).Encode(m)
+		return
 	}
-}
 
-func longpollReply(w http.ResponseWriter, m ...ClientMessage) {
-	json.NewEncoder(w).Encode(m)
+	data, err := codec.Marshal(m)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", codec.ContentType())
+	w.Write(data)
 }
 
-func (c *longpollConnection) Send(channel, message string) {
-	c.messages <- newBroadcastMessage(channel, message)
-}
-
-func (c *longpollConnection) Process(t string, args []string) {
-	switch t {
-	case "transfer":
-		select {
-		case c.transfer <- args[0]:
-		default: // Receiver might be dead and buffer is full, discard
-		}
-	case "subscribe":
-		c.subscribe <- args[0]
-	case "unsubscribe":
-		c.unsubscribe <- args[0]
-	}
+// Replies to a request, followed by any other messages.
+func longpollResult(w http.ResponseWriter, codec Codec, request, reply ClientMessage, m ...ClientMessage) {
+	longpollReply(w, codec, append([]ClientMessage{newReply(request, reply)}, m...)...)
 }
 
 func (c *longpollConnection) GetToken() string {
 	return c.Token
 }
 
+func (c *longpollConnection) GetTransport() string {
+	return "longpoll"
+}
+
 // Client transport
 type longpollClientTransport struct {
 	poll_lock    sync.Mutex
 	running      *atomic.Bool
 	client       *Client
-	messages     chan ClientMessage
 	token        string
 	httpClient   http.Client
 	httpReq      *http.Request
 	httpReq_lock sync.Mutex
 	call         int
 
+	// Negotiated when authenticating
+	codec Codec
+
+	// Requests in flight, poll results wait for their replies: those come
+	// first when subscribing with a replay.
+	calls      int
+	calls_lock sync.Mutex
+	calls_done *sync.Cond
+
+	// Closed once polling stops
+	messages      chan ClientMessage
+	messages_lock sync.Mutex
+	closed        bool
+
+	// Acks are posted in the background, so they don't hold up receiving
+	acks      chan ClientMessage
+	acks_once sync.Once
+
+	// Closed when the transport closes
+	stop      chan struct{}
+	stop_once sync.Once
+
 	err      error
 	err_lock sync.Mutex
 }
 
 func newlongpollClientTransport(c *Client) clientTransport {
-	return &longpollClientTransport{
+	t := &longpollClientTransport{
 		running:  atomic.NewBool(false),
 		client:   c,
+		codec:    JSON,
 		messages: make(chan ClientMessage, 10),
+		acks:     make(chan ClientMessage, 100),
+		stop:     make(chan struct{}),
 		httpClient: http.Client{
 			Transport: http.DefaultTransport,
 		},
 	}
+	t.calls_done = sync.NewCond(&t.calls_lock)
+	return t
 }
 
-func (t *longpollClientTransport) Connect(authData ClientMessage) error {
+func (t *longpollClientTransport) Connect(ctx context.Context, authData ClientMessage) error {
 	data := authData
 	if data == nil {
 		data = make(ClientMessage)
 	}
 	data["__type"] = AuthMessage
+	if t.client.Codec != nil {
+		data["__codec"] = t.client.Codec.Name()
+	}
 
 	if t.client.skip_auth {
 		data = ClientMessage{}
 	}
 
-	return t.Send(data)
+	return t.Send(ctx, data)
 }
 
 func (t *longpollClientTransport) Close() error {
 	t.running.Store(false)
+	t.stop_once.Do(func() {
+		close(t.stop)
+	})
 
 	t.httpReq_lock.Lock()
 	defer t.httpReq_lock.Unlock()
@@ -309,21 +481,63 @@ func (t *longpollClientTransport) Close() error {
 	return nil
 }
 
-func (t *longpollClientTransport) Send(data ClientMessage) error {
+func (t *longpollClientTransport) Send(ctx context.Context, data ClientMessage) error {
 	data["__token"] = t.token
 
-	buf, err := json.Marshal(data)
+	if data.Type() == AckMessage {
+		t.acks_once.Do(func() {
+			go t.sendAcks()
+		})
+		select {
+		case t.acks <- data:
+			return nil
+		case <-t.stop:
+			return io.EOF
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	t.calls_lock.Lock()
+	t.calls++
+	t.calls_lock.Unlock()
+	defer func() {
+		t.calls_lock.Lock()
+		t.calls--
+		if t.calls == 0 {
+			t.calls_done.Broadcast()
+		}
+		t.calls_lock.Unlock()
+	}()
+	return t.post(ctx, data)
+}
+
+// Acks have no reply to wait for, so they don't count as calls. Failed acks
+// get redelivered.
+func (t *longpollClientTransport) sendAcks() {
+	for {
+		select {
+		case data := <-t.acks:
+			t.post(context.Background(), data)
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *longpollClientTransport) post(ctx context.Context, data ClientMessage) error {
+	buf, err := t.codec.Marshal(data)
 	if err != nil {
 		return err
 	}
 
 	url := t.client.url(ClientModeLongPoll)
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(buf))
 	if err != nil {
 		return err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", t.codec.ContentType())
 	if t.client.UserAgent != "" {
 		req.Header.Set("User-Agent", t.client.UserAgent)
 	}
@@ -342,13 +556,12 @@ func (t *longpollClientTransport) Send(data ClientMessage) error {
 		return fmt.Errorf("Non OK status code: %d -> %s", resp.StatusCode, string(body))
 	}
 
-	result := []ClientMessage{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	result, err := t.readReply(resp)
 	if err != nil {
 		return err
 	}
 	for _, v := range result {
-		t.messages <- v
+		t.push(v)
 	}
 	return nil
 }
@@ -366,15 +579,38 @@ func (t *longpollClientTransport) Receive() (ClientMessage, error) {
 	}
 	if m.Type() == AuthOKMessage {
 		t.token = m.Token()
+		if codec := t.client.Codec; codec != nil && codec.Name() == m.Codec() {
+			t.codec = codec
+		}
 	}
 	return m, nil
 }
 
+// Decodes a reply, using the codec that matches its content type.
+func (t *longpollClientTransport) readReply(resp *http.Response) ([]ClientMessage, error) {
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	codec := codecForContentType([]Codec{t.codec}, resp.Header.Get("Content-Type"))
+	result := []ClientMessage{}
+	err = codec.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (t *longpollClientTransport) onConnect() {
 	t.running.Store(true)
 	go t.poll()
 }
 
+func (t *longpollClientTransport) mode() ClientMode {
+	return ClientModeLongPoll
+}
+
 func (t *longpollClientTransport) poll() {
 	t.poll_lock.Lock()
 	defer t.poll_lock.Unlock()
@@ -382,13 +618,43 @@ func (t *longpollClientTransport) poll() {
 	for t.running.Load() {
 		err := t.pollOnce()
 		if err != nil {
+			t.finish(err)
 			return
 		}
 	}
 
 	t.httpReq_lock.Lock()
-	defer t.httpReq_lock.Unlock()
 	t.httpReq = nil
+	t.httpReq_lock.Unlock()
+	t.finish(nil)
+}
+
+// Passes a message to Receive, unless the transport has stopped.
+func (t *longpollClientTransport) push(m ClientMessage) {
+	t.messages_lock.Lock()
+	defer t.messages_lock.Unlock()
+	if !t.closed {
+		t.messages <- m
+	}
+}
+
+// Stops passing messages, Receive returns the error once drained. The client
+// reconnects when this happens unexpectedly.
+func (t *longpollClientTransport) finish(err error) {
+	t.messages_lock.Lock()
+	defer t.messages_lock.Unlock()
+	if t.closed {
+		return
+	}
+	t.closed = true
+
+	if err != nil {
+		t.err_lock.Lock()
+		if t.err == nil {
+			t.err = err
+		}
+		t.err_lock.Unlock()
+	}
 	close(t.messages)
 }
 
@@ -401,47 +667,54 @@ func (t *longpollClientTransport) pollOnce() error {
 	}
 	t.call++
 
-	buf, err := json.Marshal(data)
+	buf, err := t.codec.Marshal(data)
 	if err != nil {
 		return err
 	}
 	req, err := http.NewRequest("POST", url, bytes.NewBuffer(buf))
 	if err != nil {
-		t.client.disconnected()
 		return err
 	}
 
 	t.httpReq_lock.Lock()
 	t.httpReq = req
 	t.httpReq_lock.Unlock()
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", t.codec.ContentType())
 	if t.client.UserAgent != "" {
 		req.Header.Set("User-Agent", t.client.UserAgent)
 	}
 
 	resp, err := t.httpClient.Do(req)
 	if err != nil {
-		t.client.disconnected()
 		return err
 	}
 
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusUnauthorized {
-		t.client.disconnected()
-		return err
+		return fmt.Errorf("Non OK status code: %d", resp.StatusCode)
 	}
 
 	if !t.running.Load() {
 		return nil
 	}
 
-	result := []ClientMessage{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+	result, err := t.readReply(resp)
 	if err != nil {
 		return err
 	}
+
+	t.calls_lock.Lock()
+	for t.calls > 0 {
+		t.calls_done.Wait()
+	}
+	t.calls_lock.Unlock()
+
 	for _, v := range result {
-		t.messages <- v
+		if v.Type() == ReconnectMessage {
+			// Server is going away
+			return errReconnect
+		}
+		t.push(v)
 	}
 
 	return nil
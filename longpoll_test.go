@@ -1,6 +1,14 @@
 package broadcaster
 
-import "testing"
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
 
 func TestLPClient(t *testing.T) {
 	testClient(t, newLPClient)
@@ -18,5 +26,193 @@ func TestLPCanSubscribe(t *testing.T) {
 	testCanSubscribe(t, newLPClient)
 }
 
+func TestLPServerPublish(t *testing.T) {
+	testServerPublish(t, newLPClient)
+}
+
+func TestLPClientPublish(t *testing.T) {
+	testClientPublish(t, newLPClient)
+}
+
+func TestLPHistory(t *testing.T) {
+	testHistory(t, newLPClient)
+}
+
+func TestLPMessageIDs(t *testing.T) {
+	testMessageIDs(t, newLPClient)
+}
+
+func TestLPPresence(t *testing.T) {
+	testPresence(t, newLPClient)
+}
+
+func TestLPClusterStats(t *testing.T) {
+	testClusterStats(t, newLPClient)
+}
+
+func TestLPMetrics(t *testing.T) {
+	testMetrics(t, newLPClient)
+}
+
+func TestLPShutdown(t *testing.T) {
+	testShutdown(t, newLPClient)
+}
+
+func TestLPPatternSubscribe(t *testing.T) {
+	testPatternSubscribe(t, newLPClient)
+}
+
+func TestLPSubscribeMany(t *testing.T) {
+	testSubscribeMany(t, newLPClient)
+}
+
+func TestLPAck(t *testing.T) {
+	testAck(t, newLPClient)
+}
+
+func TestLPAutoAck(t *testing.T) {
+	testAutoAck(t, newLPClient)
+}
+
+func TestLPSubscribeFunc(t *testing.T) {
+	testSubscribeFunc(t, newLPClient)
+}
+
+func TestLPContext(t *testing.T) {
+	testContext(t, newLPClient)
+}
+
+func TestLPReconnectPolicy(t *testing.T) {
+	testReconnectPolicy(t, newLPClient)
+}
+
+func TestLPResubscribeRefused(t *testing.T) {
+	testResubscribeRefused(t, newLPClient)
+}
+
+func TestLPState(t *testing.T) {
+	testState(t, newLPClient)
+}
+
+func TestLPCodec(t *testing.T) {
+	testCodec(t, newLPClient)
+}
+
+func TestLPAuthenticator(t *testing.T) {
+	testAuthenticator(t, newLPClient)
+}
+
+func TestLPSignedChannel(t *testing.T) {
+	testSignedChannel(t, newLPClient)
+}
+
+func TestLPHistoryLive(t *testing.T) {
+	testHistoryLive(t, newLPClient)
+}
+
+func TestLPSubscribeManyLarge(t *testing.T) {
+	testSubscribeManyLarge(t, newLPClient)
+}
+
+func TestLPResumeOwnership(t *testing.T) {
+	testResumeOwnership(t, newLPClient)
+}
+
+func TestLPConnectResubscribeFails(t *testing.T) {
+	testConnectResubscribeFails(t, newLPClient)
+}
+
+func TestLPMaxMessageSize(t *testing.T) {
+	server, err := startServer(&Server{
+		MaxMessageSize: 1000,
+		Codecs:         []Codec{MessagePack},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Deeply nested, would overflow the stack without a depth limit
+	body := append(bytes.Repeat([]byte{0x91}, 20000), 0xc0)
+	req := httptest.NewRequest("POST", "/broadcaster/", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", MessagePack.ContentType())
+	w := httptest.NewRecorder()
+	server.Broadcaster.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected body to be refused, got %d", w.Code)
+	}
+}
+
+func TestLPForgedIdentity(t *testing.T) {
+	testForgedIdentity(t, newLPClient)
+}
+
+func TestLPConcurrentPublish(t *testing.T) {
+	testConcurrentPublish(t, newLPClient)
+}
+
+func TestLPSlowAck(t *testing.T) {
+	testSlowAck(t, newLPClient)
+}
+
+func TestLPCompression(t *testing.T) {
+	server, err := startServer(&Server{
+		EnableCompression:    true,
+		CompressionThreshold: 200,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	post := func(m ClientMessage) *httptest.ResponseRecorder {
+		buf, err := json.Marshal(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("POST", "/broadcaster/", bytes.NewBuffer(buf))
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.Broadcaster.ServeHTTP(w, req)
+		return w
+	}
+
+	// Small replies aren't compressed
+	w := post(ClientMessage{"__type": AuthMessage})
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Unexpected encoding: %s", w.Header().Get("Content-Encoding"))
+	}
+	result := []ClientMessage{}
+	err = json.NewDecoder(w.Body).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := result[0].Token()
+
+	// Status codes are kept
+	w = post(ClientMessage{"__type": "bla"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Unexpected status code: %d", w.Code)
+	}
+
+	channel := strings.Repeat("long", 100)
+	w = post(ClientMessage{"__type": SubscribeMessage, "__token": token, "channel": channel})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %#v", w.Header())
+	}
+	r, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result = []ClientMessage{}
+	err = json.NewDecoder(r).Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result) != 1 || result[0].Type() != SubscribeOKMessage || result[0].Channel() != channel {
+		t.Errorf("Unexpected reply: %#v", result)
+	}
+}
+
 // TODO: Test switching between servers, known tokens from other server should be accepted and transferred.
 // TODO: Keep listening after longpoll disconnect, until transferred to different request.
@@ -0,0 +1,719 @@
+package broadcaster
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type memorySession struct {
+	auth    ClientMessage
+	expires time.Time
+}
+
+type memoryChannels struct {
+	channels map[string]bool
+	expires  time.Time
+}
+
+type memoryBacklog struct {
+	messages []ClientMessage
+	expires  time.Time
+}
+
+type memoryCursor struct {
+	fields  map[string]string
+	expires time.Time
+}
+
+type memoryNode struct {
+	stats   NodeStats
+	expires time.Time
+}
+
+type memoryPending struct {
+	messages map[string]PendingMessage
+	expires  time.Time
+}
+
+type memoryPresence struct {
+	entry   PresenceEntry
+	expires time.Time
+}
+
+type memorySequence struct {
+	id      int64
+	expires time.Time
+}
+
+type memoryHistory struct {
+	messages []Message
+	expires  time.Time
+}
+
+// In-process backend, only useful when running a single node.
+type memoryBackend struct {
+	timeout time.Duration
+
+	sessions  map[string]*memorySession
+	channels  map[string]*memoryChannels
+	patterns  map[string]*memoryChannels
+	backlogs  map[string]*memoryBacklog
+	cursors   map[string]*memoryCursor
+	history   map[string]*memoryHistory
+	sequences map[string]*memorySequence
+	presence  map[string]map[string]*memoryPresence
+	pending   map[string]*memoryPending
+	nodes     map[string]*memoryNode
+
+	subscriptions  map[string]bool
+	psubscriptions map[string]bool
+
+	messages  chan BackendMessage
+	quit      chan struct{}
+	quit_once sync.Once
+
+	sync.Mutex
+}
+
+var (
+	errUnknownSession = errors.New("Unknown session")
+	errBackendClosed  = errors.New("Backend closed")
+)
+
+// NewMemoryBackend creates a Backend that keeps all data in memory. It does
+// not share anything with other processes, so it can only be used for
+// single-node deployments.
+//
+// The timeout should match the Timeout of the Server that uses it.
+func NewMemoryBackend(timeout time.Duration) Backend {
+	b := &memoryBackend{
+		// Matches the Redis backend, which rounds up to whole seconds.
+		timeout:        timeout + time.Second,
+		sessions:       make(map[string]*memorySession),
+		channels:       make(map[string]*memoryChannels),
+		patterns:       make(map[string]*memoryChannels),
+		backlogs:       make(map[string]*memoryBacklog),
+		cursors:        make(map[string]*memoryCursor),
+		history:        make(map[string]*memoryHistory),
+		sequences:      make(map[string]*memorySequence),
+		presence:       make(map[string]map[string]*memoryPresence),
+		pending:        make(map[string]*memoryPending),
+		nodes:          make(map[string]*memoryNode),
+		subscriptions:  make(map[string]bool),
+		psubscriptions: make(map[string]bool),
+		messages:       make(chan BackendMessage, 250),
+		quit:           make(chan struct{}),
+	}
+
+	go b.expire()
+
+	return b
+}
+
+// Periodically cleans up expired data
+func (b *memoryBackend) expire() {
+	for {
+		select {
+		case <-time.After(b.timeout):
+		case <-b.quit:
+			return
+		}
+
+		now := time.Now()
+		b.Lock()
+		for k, v := range b.sessions {
+			if now.After(v.expires) {
+				delete(b.sessions, k)
+			}
+		}
+		for k, v := range b.channels {
+			if now.After(v.expires) {
+				delete(b.channels, k)
+			}
+		}
+		for k, v := range b.patterns {
+			if now.After(v.expires) {
+				delete(b.patterns, k)
+			}
+		}
+		for k, v := range b.backlogs {
+			if now.After(v.expires) {
+				delete(b.backlogs, k)
+			}
+		}
+		for k, v := range b.cursors {
+			if now.After(v.expires) {
+				delete(b.cursors, k)
+			}
+		}
+		for k, v := range b.history {
+			if now.After(v.expires) {
+				delete(b.history, k)
+			}
+		}
+		for channel, entries := range b.presence {
+			for k, v := range entries {
+				if now.After(v.expires) {
+					delete(entries, k)
+				}
+			}
+			if len(entries) == 0 {
+				delete(b.presence, channel)
+			}
+		}
+		for k, v := range b.sequences {
+			if now.After(v.expires) {
+				delete(b.sequences, k)
+			}
+		}
+		for k, v := range b.pending {
+			if now.After(v.expires) {
+				delete(b.pending, k)
+			}
+		}
+		b.Unlock()
+	}
+}
+
+func (b *memoryBackend) control(format string, args ...interface{}) error {
+	return b.send(BackendMessage{
+		Data:    []byte(fmt.Sprintf(format, args...)),
+		Control: true,
+		Time:    time.Now(),
+	})
+}
+
+// Hands a message to the reader, fails once the backend is closed.
+func (b *memoryBackend) send(m BackendMessage) error {
+	select {
+	case b.messages <- m:
+		return nil
+	case <-b.quit:
+		return errBackendClosed
+	}
+}
+
+func (b *memoryBackend) Messages() <-chan BackendMessage {
+	return b.messages
+}
+
+func (b *memoryBackend) Subscribe(channel string) {
+	b.Lock()
+	defer b.Unlock()
+	b.subscriptions[channel] = true
+}
+
+func (b *memoryBackend) Unsubscribe(channel string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.subscriptions, channel)
+}
+
+func (b *memoryBackend) PSubscribe(pattern string) {
+	b.Lock()
+	defer b.Unlock()
+	b.psubscriptions[pattern] = true
+}
+
+func (b *memoryBackend) PUnsubscribe(pattern string) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.psubscriptions, pattern)
+}
+
+func (b *memoryBackend) Publish(m Message) error {
+	b.Lock()
+	subscribed := b.subscriptions[m.Channel]
+	patterns := make([]string, 0)
+	for pattern, _ := range b.psubscriptions {
+		if globMatch(pattern, m.Channel) {
+			patterns = append(patterns, pattern)
+		}
+	}
+	b.Unlock()
+
+	msg := BackendMessage{
+		Channel: m.Channel,
+		Data:    []byte(m.Body),
+		ID:      m.ID,
+		Time:    m.Time,
+	}
+	if subscribed {
+		err := b.send(msg)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Like Redis, deliver once for every matching pattern
+	for _, pattern := range patterns {
+		msg.Pattern = pattern
+		err := b.send(msg)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) NextID(channel string, ttl time.Duration) (string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	seq, ok := b.sequences[channel]
+	if !ok || time.Now().After(seq.expires) {
+		seq = &memorySequence{}
+		b.sequences[channel] = seq
+	}
+	seq.id++
+	seq.expires = time.Now().Add(ttl)
+	return strconv.FormatInt(seq.id, 10), nil
+}
+
+func (b *memoryBackend) StoreHistory(channel string, m Message, length int, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	h, ok := b.history[channel]
+	if !ok || time.Now().After(h.expires) {
+		h = &memoryHistory{}
+		b.history[channel] = h
+	}
+	h.messages = append(h.messages, m)
+	if len(h.messages) > length {
+		h.messages = h.messages[len(h.messages)-length:]
+	}
+	h.expires = time.Now().Add(ttl)
+	return nil
+}
+
+func (b *memoryBackend) GetHistory(channel string) ([]Message, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	h, ok := b.history[channel]
+	if !ok || time.Now().After(h.expires) {
+		return []Message{}, nil
+	}
+
+	result := make([]Message, len(h.messages))
+	copy(result, h.messages)
+	return result, nil
+}
+
+func (b *memoryBackend) Notify(channel string, m ClientMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	return b.control("notify %s %s", channel, data)
+}
+
+func (b *memoryBackend) AddPresence(channel string, p PresenceEntry, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	if _, ok := b.presence[channel]; !ok {
+		b.presence[channel] = make(map[string]*memoryPresence)
+	}
+	b.presence[channel][p.ID] = &memoryPresence{
+		entry:   p,
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (b *memoryBackend) RemovePresence(channel, id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.presence[channel], id)
+	if len(b.presence[channel]) == 0 {
+		delete(b.presence, channel)
+	}
+	return nil
+}
+
+func (b *memoryBackend) RefreshPresence(channel string, ids []string, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	expires := time.Now().Add(ttl)
+	for _, id := range ids {
+		if p, ok := b.presence[channel][id]; ok {
+			p.expires = expires
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) GetPresence(channel string) ([]PresenceEntry, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	result := make([]PresenceEntry, 0, len(b.presence[channel]))
+	for _, p := range b.presence[channel] {
+		if now.After(p.expires) {
+			continue
+		}
+		result = append(result, p.entry)
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) AddPending(key string, messages []PendingMessage, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	p, ok := b.pending[key]
+	if !ok || time.Now().After(p.expires) {
+		p = &memoryPending{
+			messages: make(map[string]PendingMessage),
+		}
+		b.pending[key] = p
+	}
+	for _, m := range messages {
+		p.messages[pendingField(m.Channel, m.ID)] = m
+	}
+	p.expires = time.Now().Add(ttl)
+	return nil
+}
+
+func (b *memoryBackend) RemovePending(key, channel, id string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	p, ok := b.pending[key]
+	if !ok {
+		return nil
+	}
+	delete(p.messages, pendingField(channel, id))
+	if len(p.messages) == 0 {
+		delete(b.pending, key)
+	}
+	return nil
+}
+
+func (b *memoryBackend) GetPending(keys []string) (map[string][]PendingMessage, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	result := make(map[string][]PendingMessage)
+	for _, key := range keys {
+		p, ok := b.pending[key]
+		if !ok || time.Now().After(p.expires) {
+			result[key] = []PendingMessage{}
+			continue
+		}
+
+		messages := make([]PendingMessage, 0, len(p.messages))
+		for _, m := range p.messages {
+			messages = append(messages, m)
+		}
+		result[key] = messages
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) StoreNodeStats(stats NodeStats, ttl time.Duration) error {
+	b.Lock()
+	defer b.Unlock()
+
+	b.nodes[stats.NodeID] = &memoryNode{
+		stats:   stats,
+		expires: time.Now().Add(ttl),
+	}
+	return nil
+}
+
+func (b *memoryBackend) GetNodeStats() ([]NodeStats, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	result := make([]NodeStats, 0, len(b.nodes))
+	for k, v := range b.nodes {
+		if now.After(v.expires) {
+			delete(b.nodes, k)
+			continue
+		}
+		result = append(result, v.stats)
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) IsListening() bool {
+	return true
+}
+
+func (b *memoryBackend) Close() error {
+	b.quit_once.Do(func() {
+		close(b.quit)
+	})
+	return nil
+}
+
+func (b *memoryBackend) GetConnected() (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return len(b.sessions), nil
+}
+
+func (b *memoryBackend) StoreSession(token string, auth ClientMessage) error {
+	// No need to store these
+	delete(auth, "__token")
+	delete(auth, "__type")
+
+	data := make(ClientMessage)
+	for k, v := range auth {
+		data[k] = v
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	b.sessions[token] = &memorySession{
+		auth:    data,
+		expires: time.Now().Add(b.timeout),
+	}
+	return nil
+}
+
+func (b *memoryBackend) UpdateSession(token string, auth ClientMessage) error {
+	delete(auth, "__token")
+	delete(auth, "__type")
+
+	data := make(ClientMessage)
+	for k, v := range auth {
+		data[k] = v
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	s := b.getSession(token)
+	if s == nil {
+		return errUnknownSession
+	}
+	s.auth = data
+	return nil
+}
+
+func (b *memoryBackend) DeleteSession(token string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.sessions, token)
+	delete(b.channels, token)
+	delete(b.patterns, token)
+	delete(b.cursors, token)
+	return nil
+}
+
+// Returns the session, if it hasn't expired. Lock must be held.
+func (b *memoryBackend) getSession(token string) *memorySession {
+	s, ok := b.sessions[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.expires) {
+		delete(b.sessions, token)
+		return nil
+	}
+	return s
+}
+
+func (b *memoryBackend) GetSession(token string) (ClientMessage, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	s := b.getSession(token)
+	if s == nil {
+		return nil, errUnknownSession
+	}
+
+	data := make(ClientMessage)
+	for k, v := range s.auth {
+		data[k] = v
+	}
+	return data, nil
+}
+
+func (b *memoryBackend) IsConnected(token string) (bool, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.getSession(token) != nil, nil
+}
+
+// Returns the channels (or patterns) of a connection, if they haven't
+// expired. Lock must be held.
+func (b *memoryBackend) getChannels(m map[string]*memoryChannels, token string) *memoryChannels {
+	c, ok := m[token]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(c.expires) {
+		delete(m, token)
+		return nil
+	}
+	return c
+}
+
+func (b *memoryBackend) addChannel(m map[string]*memoryChannels, token, channel string) {
+	b.Lock()
+	defer b.Unlock()
+
+	c := b.getChannels(m, token)
+	if c == nil {
+		c = &memoryChannels{
+			channels: make(map[string]bool),
+		}
+		m[token] = c
+	}
+	c.channels[channel] = true
+	c.expires = time.Now().Add(b.timeout)
+}
+
+func (b *memoryBackend) removeChannel(m map[string]*memoryChannels, token, channel string) {
+	b.Lock()
+	defer b.Unlock()
+
+	c := b.getChannels(m, token)
+	if c != nil {
+		delete(c.channels, channel)
+	}
+}
+
+func (b *memoryBackend) listChannels(m map[string]*memoryChannels, token string) []string {
+	b.Lock()
+	defer b.Unlock()
+
+	result := make([]string, 0)
+	c := b.getChannels(m, token)
+	if c == nil {
+		return result
+	}
+	for channel := range c.channels {
+		result = append(result, channel)
+	}
+	return result
+}
+
+func (b *memoryBackend) LongpollSubscribe(token, channel string) error {
+	b.addChannel(b.channels, token, channel)
+	return b.control("subscribe %s %s", token, channel)
+}
+
+func (b *memoryBackend) LongpollUnsubscribe(token, channel string) error {
+	b.removeChannel(b.channels, token, channel)
+	return b.control("unsubscribe %s %s", token, channel)
+}
+
+func (b *memoryBackend) LongpollGetChannels(token string) ([]string, error) {
+	return b.listChannels(b.channels, token), nil
+}
+
+func (b *memoryBackend) LongpollPSubscribe(token, pattern string) error {
+	b.addChannel(b.patterns, token, pattern)
+	return b.control("psubscribe %s %s", token, pattern)
+}
+
+func (b *memoryBackend) LongpollPUnsubscribe(token, pattern string) error {
+	b.removeChannel(b.patterns, token, pattern)
+	return b.control("punsubscribe %s %s", token, pattern)
+}
+
+func (b *memoryBackend) LongpollGetPatterns(token string) ([]string, error) {
+	return b.listChannels(b.patterns, token), nil
+}
+
+func (b *memoryBackend) LongpollPing(token string) error {
+	b.Lock()
+	defer b.Unlock()
+
+	// Use double expire time: the initial waiting time of the request +
+	// allowed lingering time.
+	expires := time.Now().Add(b.timeout * 2)
+	if c := b.getChannels(b.channels, token); c != nil {
+		c.expires = expires
+	}
+	if c := b.getChannels(b.patterns, token); c != nil {
+		c.expires = expires
+	}
+	if s := b.getSession(token); s != nil {
+		s.expires = expires
+	}
+	return nil
+}
+
+func (b *memoryBackend) LongpollBacklog(token string, m ClientMessage) error {
+	data := make(ClientMessage)
+	for k, v := range m {
+		data[k] = v
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	l, ok := b.backlogs[token]
+	if !ok || time.Now().After(l.expires) {
+		l = &memoryBacklog{}
+		b.backlogs[token] = l
+	}
+	l.messages = append(l.messages, data)
+	l.expires = time.Now().Add(b.timeout)
+	return nil
+}
+
+func (b *memoryBackend) LongpollTransfer(token string, seq string) error {
+	return b.control("transfer %s %s", token, seq)
+}
+
+func (b *memoryBackend) LongpollStoreCursor(token string, fields map[string]string, reset bool) error {
+	b.Lock()
+	defer b.Unlock()
+
+	c, ok := b.cursors[token]
+	if !ok || reset || time.Now().After(c.expires) {
+		c = &memoryCursor{fields: make(map[string]string)}
+		b.cursors[token] = c
+	}
+	for k, v := range fields {
+		c.fields[k] = v
+	}
+	c.expires = time.Now().Add(b.timeout * 2)
+	return nil
+}
+
+func (b *memoryBackend) LongpollGetCursor(token string) (map[string]string, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	result := make(map[string]string)
+	c, ok := b.cursors[token]
+	if !ok || time.Now().After(c.expires) {
+		return result, nil
+	}
+	for k, v := range c.fields {
+		result[k] = v
+	}
+	return result, nil
+}
+
+func (b *memoryBackend) LongpollGetBacklog(token string, result chan ClientMessage) {
+	b.Lock()
+	l, ok := b.backlogs[token]
+	delete(b.backlogs, token)
+	b.Unlock()
+
+	if !ok || time.Now().After(l.expires) {
+		return
+	}
+
+	for _, data := range l.messages {
+		result <- data
+	}
+}
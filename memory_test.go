@@ -0,0 +1,330 @@
+package broadcaster
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySession(t *testing.T) {
+	b := NewMemoryBackend(0)
+
+	err := b.StoreSession("abc", ClientMessage{"__type": AuthMessage, "token": "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := b.IsConnected("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Error("Expected session to exist")
+	}
+
+	auth, err := b.GetSession("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth["token"] != "test" || auth.Type() != "" {
+		t.Errorf("Unexpected session data: %#v", auth)
+	}
+
+	connected, _ := b.GetConnected()
+	if connected != 1 {
+		t.Errorf("Unexpected connection count: %d", connected)
+	}
+
+	// Sessions expire when not kept alive
+	time.Sleep(1100 * time.Millisecond)
+	ok, err = b.IsConnected("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Expected session to expire")
+	}
+	_, err = b.GetSession("abc")
+	if err == nil {
+		t.Error("Expected error")
+	}
+}
+
+func TestMemoryConnected(t *testing.T) {
+	b := NewMemoryBackend(0)
+
+	// Storing a session twice counts it once
+	for i := 0; i < 2; i++ {
+		err := b.StoreSession("abc", ClientMessage{"token": "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	connected, _ := b.GetConnected()
+	if connected != 1 {
+		t.Errorf("Unexpected connection count: %d", connected)
+	}
+
+	// Deleting unknown sessions doesn't change the count
+	err := b.DeleteSession("def")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected, _ = b.GetConnected()
+	if connected != 1 {
+		t.Errorf("Unexpected connection count: %d", connected)
+	}
+
+	// Expired sessions are no longer counted
+	time.Sleep(1100 * time.Millisecond)
+	_, err = b.GetSession("abc")
+	if err == nil {
+		t.Error("Expected error")
+	}
+	connected, _ = b.GetConnected()
+	if connected != 0 {
+		t.Errorf("Unexpected connection count: %d", connected)
+	}
+}
+
+func TestMemoryLongpoll(t *testing.T) {
+	b := NewMemoryBackend(1 * time.Second)
+
+	err := b.LongpollSubscribe("abc", testChannel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := <-b.Messages()
+	if !m.Control || string(m.Data) != "subscribe abc test" {
+		t.Errorf("Unexpected control message: %#v", m)
+	}
+
+	channels, err := b.LongpollGetChannels("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(channels) != 1 || channels[0] != testChannel {
+		t.Errorf("Unexpected channels: %#v", channels)
+	}
+
+	err = b.LongpollBacklog("abc", newBroadcastMessage(Message{Channel: testChannel, Body: "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.LongpollBacklog("abc", newBroadcastMessage(Message{Channel: testChannel, Body: "2"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan ClientMessage, 10)
+	b.LongpollGetBacklog("abc", result)
+	if len(result) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(result))
+	}
+	msg := <-result
+	if msg.Type() != MessageMessage || msg["body"] != "1" {
+		t.Errorf("Unexpected message: %#v", msg)
+	}
+
+	// Backlog is emptied
+	b.LongpollGetBacklog("abc", result)
+	if len(result) != 1 {
+		t.Errorf("Expected 1 message, got %d", len(result))
+	}
+}
+
+func TestMemoryCursor(t *testing.T) {
+	b := NewMemoryBackend(1 * time.Second)
+
+	err := b.LongpollStoreCursor("a", map[string]string{"stream": "x", "c:test": "0:1"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.LongpollStoreCursor("a", map[string]string{"c:other": "1:5"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields, err := b.LongpollGetCursor("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 3 || fields["c:other"] != "1:5" {
+		t.Errorf("Unexpected fields: %#v", fields)
+	}
+
+	// Resetting drops the old fields
+	err = b.LongpollStoreCursor("a", map[string]string{"stream": "y"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields, err = b.LongpollGetCursor("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 1 || fields["stream"] != "y" {
+		t.Errorf("Unexpected fields: %#v", fields)
+	}
+}
+
+func TestMemoryCursorExpire(t *testing.T) {
+	b := NewMemoryBackend(0).(*memoryBackend)
+	defer b.Close()
+
+	err := b.LongpollStoreCursor("a", map[string]string{"stream": "x"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired cursors are swept, even when never read again
+	time.Sleep(3500 * time.Millisecond)
+	b.Lock()
+	n := len(b.cursors)
+	b.Unlock()
+	if n != 0 {
+		t.Errorf("Expected cursor to be swept, got %d", n)
+	}
+}
+
+func TestMemoryNodeStats(t *testing.T) {
+	b := NewMemoryBackend(1 * time.Second)
+
+	err := b.StoreNodeStats(NodeStats{NodeID: "a"}, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.StoreNodeStats(NodeStats{NodeID: "b"}, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := b.GetNodeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("Expected 2 nodes, got %d", len(nodes))
+	}
+
+	// Crashed nodes are dropped
+	time.Sleep(200 * time.Millisecond)
+	nodes, err = b.GetNodeStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].NodeID != "b" {
+		t.Errorf("Unexpected nodes: %#v", nodes)
+	}
+}
+
+func TestMemoryCloseTwice(t *testing.T) {
+	b := NewMemoryBackend(1 * time.Second)
+
+	err := b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemoryPending(t *testing.T) {
+	b := NewMemoryBackend(1 * time.Second)
+
+	m := PendingMessage{
+		Message: Message{Channel: "test", ID: "1", Body: "Test message"},
+		Sent:    time.Now(),
+	}
+	err := b.AddPending("token", []PendingMessage{m}, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding it again replaces it
+	m.Sent = time.Now()
+	err = b.AddPending("token", []PendingMessage{m}, 1*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := b.GetPending([]string{"token", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending["token"]) != 1 || pending["token"][0].Body != "Test message" || len(pending["other"]) != 0 {
+		t.Errorf("Unexpected pending messages: %#v", pending)
+	}
+
+	err = b.RemovePending("token", "test", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err = b.GetPending([]string{"token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending["token"]) != 0 {
+		t.Errorf("Unexpected pending messages: %#v", pending)
+	}
+}
+
+func TestMemorySequence(t *testing.T) {
+	b := NewMemoryBackend(0).(*memoryBackend)
+
+	for _, expected := range []string{"1", "2"} {
+		id, err := b.NextID("test", 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != expected {
+			t.Errorf("Expected id %s, got %s", expected, id)
+		}
+	}
+
+	// Idle sequences are removed
+	time.Sleep(1100 * time.Millisecond)
+	b.Lock()
+	count := len(b.sequences)
+	b.Unlock()
+	if count != 0 {
+		t.Errorf("Unexpected sequences: %d", count)
+	}
+
+	id, err := b.NextID("test", 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "1" {
+		t.Errorf("Expected sequence to start over, got %s", id)
+	}
+}
+
+func TestMemoryPresence(t *testing.T) {
+	b := NewMemoryBackend(0)
+
+	for _, id := range []string{"a", "b"} {
+		err := b.AddPresence("test", PresenceEntry{ID: id}, 500*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only refreshed entries are kept
+	time.Sleep(300 * time.Millisecond)
+	err := b.RefreshPresence("test", []string{"a"}, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	presence, err := b.GetPresence("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(presence) != 1 || presence[0].ID != "a" {
+		t.Errorf("Unexpected presence: %#v", presence)
+	}
+}
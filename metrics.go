@@ -0,0 +1,101 @@
+package broadcaster
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"go.uber.org/atomic"
+)
+
+// Counters kept by a Server.
+type metrics struct {
+	subscribes        atomic.Int64
+	unsubscribes      atomic.Int64
+	connectFailures   atomic.Int64
+	subscribeFailures atomic.Int64
+	backlogged        atomic.Int64
+	backlog           atomic.Int64
+	dropped           atomic.Int64
+}
+
+type metricValue struct {
+	labels string
+	value  interface{}
+}
+
+func writeMetric(w io.Writer, name, help, t string, values ...metricValue) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, t)
+	for _, v := range values {
+		if v.labels != "" {
+			fmt.Fprintf(w, "%s{%s} %v\n", name, v.labels, v.value)
+		} else {
+			fmt.Fprintf(w, "%s %v\n", name, v.value)
+		}
+	}
+}
+
+func label(name, value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return fmt.Sprintf(`%s="%s"`, name, value)
+}
+
+// MetricsHandler returns an http.Handler that serves the metrics of this
+// node in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.prepared {
+			http.Error(w, "Prepare() not called on broadcaster.Server", http.StatusInternalServerError)
+			return
+		}
+
+		stats, err := s.hub.Stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.writeMetrics(w, stats)
+	})
+}
+
+func (s *Server) writeMetrics(w io.Writer, stats hubStats) {
+	transports := []string{"websocket", "longpoll", "sse"}
+	connections := make([]metricValue, 0)
+	for _, t := range transports {
+		connections = append(connections, metricValue{label("transport", t), stats.Connections[t]})
+	}
+	writeMetric(w, "broadcaster_connections", "Number of active connections.", "gauge", connections...)
+
+	writeMetric(w, "broadcaster_channels", "Number of channels with local subscribers.", "gauge",
+		metricValue{"", len(stats.LocalSubscriptions)})
+
+	writeMetric(w, "broadcaster_subscribes_total", "Number of channel subscriptions.", "counter",
+		metricValue{"", s.metrics.subscribes.Load()})
+	writeMetric(w, "broadcaster_unsubscribes_total", "Number of channel unsubscriptions.", "counter",
+		metricValue{"", s.metrics.unsubscribes.Load()})
+	writeMetric(w, "broadcaster_auth_failures_total", "Number of refused connections and subscriptions.", "counter",
+		metricValue{label("type", "connect"), s.metrics.connectFailures.Load()},
+		metricValue{label("type", "subscribe"), s.metrics.subscribeFailures.Load()})
+	writeMetric(w, "broadcaster_messages_relayed_total", "Number of messages sent to connections.", "counter",
+		metricValue{"", stats.MessagesRelayed})
+	writeMetric(w, "broadcaster_backend_queue_length", "Number of received messages waiting to be relayed.", "gauge",
+		metricValue{"", len(s.Backend.Messages())})
+	writeMetric(w, "broadcaster_longpoll_backlog_size", "Number of messages held for long-poll and SSE clients in between polls.", "gauge",
+		metricValue{"", s.metrics.backlog.Load()})
+	writeMetric(w, "broadcaster_longpoll_backlogged_total", "Number of messages stored for long-polling clients in between polls.", "counter",
+		metricValue{"", s.metrics.backlogged.Load()})
+	writeMetric(w, "broadcaster_messages_dropped_total", "Number of messages dropped because a connection's send queue was full.", "counter",
+		metricValue{"", s.metrics.dropped.Load()})
+
+	if r, ok := s.Backend.(*redisBackend); ok {
+		writeMetric(w, "broadcaster_redis_reconnects_total", "Number of times a Redis pub/sub connection was lost and made again.", "counter",
+			metricValue{label("connection", "pubsub"), reconnects(r.pubSubDials)},
+			metricValue{label("connection", "patterns"), reconnects(r.patternDials)})
+	}
+}
@@ -0,0 +1,486 @@
+package broadcaster
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// MessagePack codec (https://msgpack.org), covers the subset needed for
+// client messages.
+//
+// Numbers are decoded as float64, maps as map[string]interface{} and binary
+// data as base64 strings, like encoding/json does. Values of other types
+// (such as structs) are encoded the way encoding/json would encode them.
+type msgpackCodec struct{}
+
+var (
+	errMsgpackShort = errors.New("Unexpected end of msgpack data")
+	errMsgpackDepth = errors.New("Exceeded max msgpack nesting depth")
+)
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpackAppend(nil, v)
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	d := &msgpackDecoder{data: data}
+	value, err := d.decode()
+	if err != nil {
+		return err
+	}
+
+	switch p := v.(type) {
+	case *interface{}:
+		*p = value
+	case *ClientMessage:
+		if value == nil {
+			*p = nil
+			return nil
+		}
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Expected msgpack map, got %T", value)
+		}
+		*p = ClientMessage(m)
+	case *[]ClientMessage:
+		if value == nil {
+			*p = nil
+			return nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("Expected msgpack array, got %T", value)
+		}
+		result := make([]ClientMessage, 0, len(list))
+		for _, entry := range list {
+			m, ok := entry.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("Expected msgpack map, got %T", entry)
+			}
+			result = append(result, ClientMessage(m))
+		}
+		*p = result
+	default:
+		// Other types go through JSON
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	return nil
+}
+
+func msgpackAppend(b []byte, v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case string:
+		return msgpackAppendString(b, v), nil
+	case []byte:
+		return msgpackAppendBinary(b, v), nil
+	case int:
+		return msgpackAppendInt(b, int64(v)), nil
+	case int8:
+		return msgpackAppendInt(b, int64(v)), nil
+	case int16:
+		return msgpackAppendInt(b, int64(v)), nil
+	case int32:
+		return msgpackAppendInt(b, int64(v)), nil
+	case int64:
+		return msgpackAppendInt(b, v), nil
+	case uint:
+		return msgpackAppendUint(b, uint64(v)), nil
+	case uint8:
+		return msgpackAppendUint(b, uint64(v)), nil
+	case uint16:
+		return msgpackAppendUint(b, uint64(v)), nil
+	case uint32:
+		return msgpackAppendUint(b, uint64(v)), nil
+	case uint64:
+		return msgpackAppendUint(b, v), nil
+	case float32:
+		b = append(b, 0xca)
+		return msgpackAppend32(b, math.Float32bits(v)), nil
+	case float64:
+		b = append(b, 0xcb)
+		return msgpackAppend64(b, math.Float64bits(v)), nil
+	case ClientMessage:
+		return msgpackAppendMap(b, v)
+	case map[string]interface{}:
+		return msgpackAppendMap(b, v)
+	case []interface{}:
+		b = msgpackAppendHeader(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, entry := range v {
+			var err error
+			b, err = msgpackAppend(b, entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case []ClientMessage:
+		b = msgpackAppendHeader(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, entry := range v {
+			var err error
+			b, err = msgpackAppendMap(b, entry)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case []string:
+		b = msgpackAppendHeader(b, len(v), 0x90, 0xdc, 0xdd)
+		for _, entry := range v {
+			b = msgpackAppendString(b, entry)
+		}
+		return b, nil
+	}
+
+	// Anything else is encoded as its JSON equivalent
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return append(b, 0xc0), nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var value interface{}
+	err = json.Unmarshal(data, &value)
+	if err != nil {
+		return nil, err
+	}
+	return msgpackAppend(b, value)
+}
+
+// Appends the header of a map, array or string: fix is used for lengths below
+// 16 (32 for strings), then 16 and 32 bit lengths.
+func msgpackAppendHeader(b []byte, n int, fix, code16, code32 byte) []byte {
+	max := 16
+	if fix == 0xa0 {
+		max = 32
+	}
+
+	switch {
+	case n < max:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		b = append(b, code16)
+		return msgpackAppend16(b, uint16(n))
+	default:
+		b = append(b, code32)
+		return msgpackAppend32(b, uint32(n))
+	}
+}
+
+func msgpackAppendString(b []byte, s string) []byte {
+	if len(s) >= 32 && len(s) <= math.MaxUint8 {
+		b = append(b, 0xd9, byte(len(s)))
+	} else {
+		b = msgpackAppendHeader(b, len(s), 0xa0, 0xda, 0xdb)
+	}
+	return append(b, s...)
+}
+
+func msgpackAppendBinary(b []byte, data []byte) []byte {
+	switch {
+	case len(data) <= math.MaxUint8:
+		b = append(b, 0xc4, byte(len(data)))
+	case len(data) <= math.MaxUint16:
+		b = append(b, 0xc5)
+		b = msgpackAppend16(b, uint16(len(data)))
+	default:
+		b = append(b, 0xc6)
+		b = msgpackAppend32(b, uint32(len(data)))
+	}
+	return append(b, data...)
+}
+
+func msgpackAppendInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return msgpackAppendUint(b, uint64(i))
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		b = append(b, 0xd1)
+		return msgpackAppend16(b, uint16(i))
+	case i >= math.MinInt32:
+		b = append(b, 0xd2)
+		return msgpackAppend32(b, uint32(i))
+	default:
+		b = append(b, 0xd3)
+		return msgpackAppend64(b, uint64(i))
+	}
+}
+
+func msgpackAppendUint(b []byte, u uint64) []byte {
+	switch {
+	case u < 128:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		b = append(b, 0xcd)
+		return msgpackAppend16(b, uint16(u))
+	case u <= math.MaxUint32:
+		b = append(b, 0xce)
+		return msgpackAppend32(b, uint32(u))
+	default:
+		b = append(b, 0xcf)
+		return msgpackAppend64(b, u)
+	}
+}
+
+// Keys are sorted, to get a stable encoding.
+func msgpackAppendMap(b []byte, m map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k, _ := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = msgpackAppendHeader(b, len(m), 0x80, 0xde, 0xdf)
+	for _, k := range keys {
+		b = msgpackAppendString(b, k)
+
+		var err error
+		b, err = msgpackAppend(b, m[k])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+func msgpackAppend16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func msgpackAppend32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func msgpackAppend64(b []byte, v uint64) []byte {
+	return msgpackAppend32(msgpackAppend32(b, uint32(v>>32)), uint32(v))
+}
+
+// Same as encoding/json, keeps deeply nested input from overflowing the stack
+const msgpackMaxDepth = 10000
+
+type msgpackDecoder struct {
+	data  []byte
+	pos   int
+	depth int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgpackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// Reads a big endian unsigned integer of n bytes.
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return float64(code), nil
+	case code >= 0xe0:
+		return float64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readUint(1 << (code - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.read(int(n))
+		if err != nil {
+			return nil, err
+		}
+		// Base64 string, like encoding/json produces for []byte
+		return base64.StdEncoding.EncodeToString(data), nil
+	case 0xca:
+		u, err := d.readUint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(u))), nil
+	case 0xcb:
+		u, err := d.readUint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(u), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := d.readUint(1 << (code - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return float64(u), nil
+	case 0xd0:
+		u, err := d.readUint(1)
+		return float64(int8(u)), err
+	case 0xd1:
+		u, err := d.readUint(2)
+		return float64(int16(u)), err
+	case 0xd2:
+		u, err := d.readUint(4)
+		return float64(int32(u)), err
+	case 0xd3:
+		u, err := d.readUint(8)
+		return float64(int64(u)), err
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readUint(1 << (code - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(int(n))
+	case 0xdc, 0xdd:
+		n, err := d.readUint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(int(n))
+	case 0xde, 0xdf:
+		n, err := d.readUint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(int(n))
+	}
+	return nil, fmt.Errorf("Unsupported msgpack type: 0x%x", code)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (interface{}, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+// Tracks the nesting depth, call leave once done.
+func (d *msgpackDecoder) enter() error {
+	d.depth++
+	if d.depth > msgpackMaxDepth {
+		return errMsgpackDepth
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	// Each entry takes at least one byte, don't trust the length blindly
+	if n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	result := make([]interface{}, 0, n)
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, v)
+	}
+	return result, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if 2*n > len(d.data)-d.pos {
+		return nil, errMsgpackShort
+	}
+	err := d.enter()
+	if err != nil {
+		return nil, err
+	}
+	defer d.leave()
+
+	result := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("Expected msgpack string key, got %T", k)
+		}
+
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		result[key] = v
+	}
+	return result, nil
+}
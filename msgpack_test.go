@@ -0,0 +1,116 @@
+package broadcaster
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessagePack(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+	list := make([]interface{}, 20)
+	for i := range list {
+		list[i] = float64(i)
+	}
+
+	tests := []interface{}{
+		nil,
+		true,
+		false,
+		"",
+		"short",
+		strings.Repeat("a", 40),
+		strings.Repeat("b", 300),
+		long,
+		float64(0),
+		float64(127),
+		float64(128),
+		float64(65536),
+		float64(1 << 40),
+		float64(-1),
+		float64(-33),
+		float64(-40000),
+		float64(-(1 << 40)),
+		1.5,
+		list,
+		[]interface{}{"a", 1.0, nil, map[string]interface{}{"b": true}},
+		map[string]interface{}{
+			"__type":  "message",
+			"channel": "test",
+			"nested":  map[string]interface{}{"list": []interface{}{"x"}},
+		},
+	}
+
+	for _, v := range tests {
+		data, err := MessagePack.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result interface{}
+		err = MessagePack.Unmarshal(data, &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result, v) {
+			t.Errorf("Round trip failed: %.50v != %.50v", result, v)
+		}
+	}
+}
+
+func TestMessagePackTypes(t *testing.T) {
+	// Decoded like encoding/json would
+	m := ClientMessage{
+		"int":     42,
+		"int64":   int64(-5),
+		"strings": []string{"a", "b"},
+		"bytes":   []byte("binary"),
+		"struct":  Message{Channel: "test", Body: "body", ID: "1"},
+	}
+
+	data, err := MessagePack.Marshal([]ClientMessage{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := []ClientMessage{}
+	err = MessagePack.Unmarshal(data, &result)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j, err := json.Marshal([]ClientMessage{m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ClientMessage{}
+	err = json.Unmarshal(j, &expected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Unexpected result: %#v", result)
+	}
+}
+
+func TestMessagePackInvalid(t *testing.T) {
+	tests := [][]byte{
+		{},
+		{0xa5, 'a'},
+		{0x92, 0x01},
+		{0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0x01, 0x02},
+		{0xc1},
+		append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth+1), 0xc0),
+	}
+
+	for _, data := range tests {
+		var v interface{}
+		err := MessagePack.Unmarshal(data, &v)
+		if err == nil {
+			t.Errorf("Expected error for %x", data)
+		}
+	}
+}
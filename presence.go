@@ -0,0 +1,105 @@
+package broadcaster
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// A PresenceEntry describes a connection that is subscribed to a channel.
+type PresenceEntry struct {
+	// Opaque id of the connection, derived from its session token. The
+	// token itself is never shared.
+	ID string `json:"id"`
+
+	// Auth data of the connection, limited to Server.PresenceFields
+	Data map[string]interface{} `json:"data"`
+}
+
+// Presence returns all connections that are subscribed to a channel, on all
+// nodes. Only available for channels enabled with TrackPresence.
+func (s *Server) Presence(channel string) ([]PresenceEntry, error) {
+	return s.Backend.GetPresence(channel)
+}
+
+func (s *Server) tracksPresence(channel string) bool {
+	return s.TrackPresence != nil && s.TrackPresence(channel)
+}
+
+func presenceID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
+}
+
+// Entries expire unless the node that holds the connection keeps them
+// alive, so crashed nodes don't leave members behind.
+func (s *Server) presenceTTL() time.Duration {
+	return 3 * s.StatsInterval
+}
+
+// Records that a connection subscribed to a channel.
+func (s *Server) join(auth ClientMessage, token, channel string) error {
+	if !s.tracksPresence(channel) {
+		return nil
+	}
+
+	p := PresenceEntry{
+		ID:   presenceID(token),
+		Data: make(map[string]interface{}),
+	}
+	for _, field := range s.PresenceFields {
+		if v, ok := auth[field]; ok {
+			p.Data[field] = v
+		}
+	}
+
+	err := s.Backend.AddPresence(channel, p, s.presenceTTL())
+	if err != nil {
+		return err
+	}
+
+	if s.PresenceEvents {
+		return s.Backend.Notify(channel, newPresenceMessage(JoinMessage, channel, p))
+	}
+	return nil
+}
+
+// Records that a connection is no longer subscribed to a channel.
+func (s *Server) leave(token, channel string) error {
+	if !s.tracksPresence(channel) {
+		return nil
+	}
+
+	id := presenceID(token)
+	err := s.Backend.RemovePresence(channel, id)
+	if err != nil {
+		return err
+	}
+
+	if s.PresenceEvents {
+		return s.Backend.Notify(channel, newPresenceMessage(LeaveMessage, channel, PresenceEntry{
+			ID: id,
+		}))
+	}
+	return nil
+}
+
+// Keeps the presence entries of local connections alive, on every
+// heartbeat.
+func (s *Server) refreshPresence() {
+	if s.TrackPresence == nil {
+		return
+	}
+
+	for channel, tokens := range s.hub.channelTokens() {
+		if !s.tracksPresence(channel) {
+			continue
+		}
+
+		ids := make([]string, 0, len(tokens))
+		for _, token := range tokens {
+			ids = append(ids, presenceID(token))
+		}
+		s.Backend.RefreshPresence(channel, ids, s.presenceTTL())
+	}
+}
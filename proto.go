@@ -1,6 +1,10 @@
 package broadcaster
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"time"
+)
 
 // Message types used between server and client.
 const (
@@ -13,6 +17,15 @@ const (
 	// Server: Authentication failed
 	AuthFailedMessage = "authError"
 
+	// Client: Send new credentials before the current ones expire
+	ReauthMessage = "reauth"
+
+	// Server: New credentials accepted
+	ReauthOKMessage = "reauthOk"
+
+	// Server: New credentials refused
+	ReauthErrorMessage = "reauthError"
+
 	// Client: Subscribe to channel
 	SubscribeMessage = "subscribe"
 
@@ -34,12 +47,63 @@ const (
 	// Server: Unsubscribe failed
 	UnsubscribeErrorMessage = "unsubscribeError"
 
+	// Client: Subscribe to multiple channels
+	SubscribeManyMessage = "subscribeMany"
+
+	// Server: Per-channel results of subscribeMany
+	SubscribeManyResultMessage = "subscribeManyResult"
+
+	// Client: Unsubscribe from multiple channels
+	UnsubscribeManyMessage = "unsubscribeMany"
+
+	// Server: Per-channel results of unsubscribeMany
+	UnsubscribeManyResultMessage = "unsubscribeManyResult"
+
+	// Client: Subscribe to all channels matching a pattern
+	PSubscribeMessage = "psubscribe"
+
+	// Server: Pattern subscribe succeeded
+	PSubscribeOKMessage = "psubscribeOk"
+
+	// Server: Pattern subscribe failed
+	PSubscribeErrorMessage = "psubscribeError"
+
+	// Client: Unsubscribe from pattern
+	PUnsubscribeMessage = "punsubscribe"
+
+	// Server: Pattern unsubscribe succeeded
+	PUnsubscribeOKMessage = "punsubscribeOk"
+
+	// Server: Pattern unsubscribe failed
+	PUnsubscribeErrorMessage = "punsubscribeError"
+
+	// Client: Publish message on channel
+	PublishMessage = "publish"
+
+	// Server: Publish succeeded
+	PublishOKMessage = "publishOk"
+
+	// Server: Publish failed
+	PublishErrorMessage = "publishError"
+
+	// Client: Message received, see Server.RequireAck
+	AckMessage = "ack"
+
+	// Server: Connection subscribed to channel
+	JoinMessage = "join"
+
+	// Server: Connection unsubscribed from channel
+	LeaveMessage = "leave"
+
 	// Client: Send me more messages
 	PollMessage = "poll"
 
 	// Client: I'm still alive
 	PingMessage = "ping"
 
+	// Server: Node is going away, reconnect
+	ReconnectMessage = "reconnect"
+
 	// Server: Unknown message
 	UnknownMessage = "unknown"
 
@@ -49,7 +113,13 @@ const (
 
 type ClientMessage map[string]interface{}
 
+// ResultId returns the key that matches a reply to its request: the id of the
+// request, when it has one.
 func (c ClientMessage) ResultId() string {
+	if id, ok := c["__id"].(string); ok {
+		return id
+	}
+
 	t := c.Type()
 	if t == SubscribeOKMessage || t == SubscribeErrorMessage {
 		t = SubscribeMessage
@@ -57,7 +127,32 @@ func (c ClientMessage) ResultId() string {
 	if t == UnsubscribeOKMessage {
 		t = UnsubscribeMessage
 	}
-	return fmt.Sprintf("%s_%s", t, c["channel"])
+	if t == PSubscribeOKMessage || t == PSubscribeErrorMessage {
+		t = PSubscribeMessage
+	}
+	if t == PUnsubscribeOKMessage || t == PUnsubscribeErrorMessage {
+		t = PUnsubscribeMessage
+	}
+	if t == PublishOKMessage || t == PublishErrorMessage {
+		t = PublishMessage
+	}
+	if t == ReauthOKMessage || t == ReauthErrorMessage {
+		t = ReauthMessage
+	}
+	if t == SubscribeManyResultMessage {
+		t = SubscribeManyMessage
+	}
+	if t == UnsubscribeManyResultMessage {
+		t = UnsubscribeManyMessage
+	}
+	if batch, ok := c["batch"]; ok {
+		return fmt.Sprintf("%s_%s", t, batch)
+	}
+	// Reauth replies have no channel
+	if t == ReauthMessage {
+		return t
+	}
+	return fmt.Sprintf("%s_%s", t, c.Channel())
 }
 
 func (c ClientMessage) Type() string {
@@ -76,6 +171,35 @@ func (c ClientMessage) Token() string {
 	return s
 }
 
+// Key to resume pending messages with after reconnecting. Set in authOk.
+func (c ClientMessage) ResumeKey() string {
+	s, ok := c[resumeKey].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// Codec requested by the client when authenticating, or accepted by the
+// server in its reply.
+func (c ClientMessage) Codec() string {
+	s, ok := c["__codec"].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// When the credentials expire, zero if they don't. Set in authOk and
+// reauthOk replies.
+func (c ClientMessage) Expires() time.Time {
+	ms, ok := c["expires"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
 func (c ClientMessage) Channel() string {
 	s, ok := c["channel"].(string)
 	if !ok {
@@ -84,6 +208,88 @@ func (c ClientMessage) Channel() string {
 	return s
 }
 
+func (c ClientMessage) Body() string {
+	s, ok := c["body"].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+func (c ClientMessage) ID() string {
+	s, ok := c["id"].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+func (c ClientMessage) Time() time.Time {
+	ms, ok := c["time"].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+func (c ClientMessage) Pattern() string {
+	s, ok := c["pattern"].(string)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// Channel entries of a subscribeMany or unsubscribeMany message. Entries can
+// either be channel names or objects with the same fields as a subscribe
+// message.
+func (c ClientMessage) Channels() []ClientMessage {
+	return messageList(c["channels"])
+}
+
+// Per-channel results of a subscribeMany or unsubscribeMany message.
+func (c ClientMessage) Results() []ClientMessage {
+	return messageList(c["results"])
+}
+
+func messageList(v interface{}) []ClientMessage {
+	switch l := v.(type) {
+	case []ClientMessage:
+		return l
+	case []interface{}:
+		result := make([]ClientMessage, 0, len(l))
+		for _, entry := range l {
+			switch e := entry.(type) {
+			case string:
+				result = append(result, ClientMessage{"channel": e})
+			case map[string]interface{}:
+				result = append(result, ClientMessage(e))
+			case ClientMessage:
+				result = append(result, e)
+			}
+		}
+		return result
+	}
+	return []ClientMessage{}
+}
+
+// AsMessage converts a broadcast message into a Message.
+func (c ClientMessage) AsMessage() Message {
+	return Message{
+		Channel: c.Channel(),
+		Body:    c.Body(),
+		Pattern: c.Pattern(),
+		ID:      c.ID(),
+		Time:    c.Time(),
+	}
+}
+
+// Whether the message has to be acknowledged.
+func (c ClientMessage) NeedsAck() bool {
+	b, _ := c["ack"].(bool)
+	return b
+}
+
 func (c ClientMessage) Reason() string {
 	s, ok := c["reason"].(string)
 	if !ok {
@@ -112,12 +318,71 @@ func newChannelMessage(t, channel string) ClientMessage {
 	}
 }
 
-func newBroadcastMessage(channel, body string) ClientMessage {
-	return ClientMessage{
+func newBroadcastMessage(m Message) ClientMessage {
+	msg := ClientMessage{
 		"__type":  MessageMessage,
+		"channel": m.Channel,
+		"body":    m.Body,
+		"time":    m.Time.UnixNano() / int64(time.Millisecond),
+	}
+	// Messages published directly on the backend have no id
+	if m.ID != "" {
+		msg["id"] = m.ID
+	}
+	if m.Pattern != "" {
+		msg["pattern"] = m.Pattern
+	}
+	return msg
+}
+
+// Most channels a single subscribeMany or unsubscribeMany request may hold.
+// Clients split larger batches.
+const MaxBatchSize = 100
+
+// Error results for all entries of a batch that's too large, nil when it
+// isn't.
+func refuseBatch(m ClientMessage, errType string) []ClientMessage {
+	entries := m.Channels()
+	if len(entries) <= MaxBatchSize {
+		return nil
+	}
+	results := make([]ClientMessage, 0, len(entries))
+	for _, entry := range entries {
+		results = append(results, newChannelErrorMessage(errType, entry.Channel(), errors.New("Batch too large")))
+	}
+	return results
+}
+
+// Replies carry the id of the request they answer, if it has one.
+func newReply(request, m ClientMessage) ClientMessage {
+	if id, ok := request["__id"]; ok {
+		m["__id"] = id
+	}
+	return m
+}
+
+// Reply to a batch request, carries the batch id of the request.
+func newBatchMessage(t string, request ClientMessage, results []ClientMessage) ClientMessage {
+	m := ClientMessage{
+		"__type":  t,
+		"results": results,
+	}
+	if batch, ok := request["batch"]; ok {
+		m["batch"] = batch
+	}
+	return m
+}
+
+func newPresenceMessage(t, channel string, p PresenceEntry) ClientMessage {
+	m := ClientMessage{
+		"__type":  t,
 		"channel": channel,
-		"body":    body,
+		"member":  p.ID,
+	}
+	if p.Data != nil {
+		m["data"] = p.Data
 	}
+	return m
 }
 
 func newChannelErrorMessage(t, channel string, err error) ClientMessage {
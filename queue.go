@@ -0,0 +1,253 @@
+package broadcaster
+
+import (
+	"sync"
+)
+
+// What happens when the send queue of a connection is full, see
+// Server.OverflowPolicy.
+type OverflowPolicy int
+
+// Overflow policies
+const (
+	// Drops the oldest queued message to make room for the new one
+	OverflowDropOldest OverflowPolicy = 0
+
+	// Drops the new message
+	OverflowDropNewest OverflowPolicy = 1
+
+	// Disconnects the client. Websocket connections are closed with
+	// Server.OverflowCloseCode, long-poll and SSE clients are told to
+	// reconnect.
+	OverflowDisconnect OverflowPolicy = 2
+)
+
+// A queued message: broadcasts are turned into client messages when they
+// are written, so dropped messages are never marked as pending.
+type queuedMessage struct {
+	broadcast *Message
+	message   ClientMessage
+}
+
+// Bounded queue of outgoing messages, written by its own goroutine. Keeps a
+// slow client from blocking delivery to everyone else.
+type sendQueue struct {
+	server   *Server
+	token    string
+	pending  string
+	write    func(m ClientMessage) error
+	overflow func()
+
+	queue      []queuedMessage
+	queue_lock sync.Mutex
+	held       map[string][]queuedMessage
+	overflowed bool
+	wake       chan struct{}
+	quit       chan struct{}
+	done       chan struct{}
+	stop_once  sync.Once
+}
+
+// Messages that need to be acknowledged are stored under the pending key, if
+// there is one.
+func newSendQueue(s *Server, token, pending string, write func(m ClientMessage) error, overflow func()) *sendQueue {
+	q := &sendQueue{
+		server:   s,
+		token:    token,
+		pending:  pending,
+		write:    write,
+		overflow: overflow,
+		wake:     make(chan struct{}, 1),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if pending != "" {
+		s.trackPending(pending, token)
+	}
+	go q.run()
+	return q
+}
+
+func (q *sendQueue) Send(m Message) {
+	q.push(queuedMessage{broadcast: &m})
+}
+
+func (q *sendQueue) Notify(m ClientMessage) {
+	q.push(queuedMessage{message: m})
+}
+
+// Never blocks, applies the overflow policy when full.
+func (q *sendQueue) push(m queuedMessage) {
+	q.queue_lock.Lock()
+	if q.overflowed {
+		q.queue_lock.Unlock()
+		q.drop(m)
+		return
+	}
+	if m.broadcast != nil && m.broadcast.Pattern == "" {
+		if held, ok := q.held[m.broadcast.Channel]; ok {
+			q.held[m.broadcast.Channel] = append(held, m)
+			q.queue_lock.Unlock()
+			return
+		}
+	}
+	if len(q.queue) >= q.server.SendQueueSize {
+		switch q.server.OverflowPolicy {
+		case OverflowDropNewest:
+			q.queue_lock.Unlock()
+			q.drop(m)
+			return
+		case OverflowDisconnect:
+			q.overflowed = true
+			q.queue_lock.Unlock()
+			q.drop(m)
+			go q.overflow()
+			return
+		default:
+			q.drop(q.queue[0])
+			q.queue = q.queue[1:]
+		}
+	}
+	q.queue = append(q.queue, m)
+	q.queue_lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default: // Already woken up
+	}
+}
+
+// Messages that need to be acknowledged are stored as pending instead of
+// getting lost, they're redelivered once the ack timeout passes. Called with
+// the hub lock held, so that happens in the background.
+func (q *sendQueue) drop(m queuedMessage) {
+	q.server.metrics.dropped.Inc()
+	if m.broadcast != nil && q.pending != "" && q.server.requiresAck(*m.broadcast) {
+		go q.server.deliver(q.pending, []Message{*m.broadcast})
+	}
+}
+
+// Holds back messages on a channel while subscribing to it, so they can't
+// overtake the replayed history.
+func (q *sendQueue) hold(channel string) {
+	q.queue_lock.Lock()
+	defer q.queue_lock.Unlock()
+	if q.held == nil {
+		q.held = make(map[string][]queuedMessage)
+	}
+	if _, ok := q.held[channel]; !ok {
+		q.held[channel] = nil
+	}
+}
+
+// Queues the replayed messages, followed by the held back ones that weren't
+// replayed already.
+func (q *sendQueue) release(channel string, replay []ClientMessage) {
+	q.queue_lock.Lock()
+	held := q.held[channel]
+	delete(q.held, channel)
+	if q.overflowed {
+		q.queue_lock.Unlock()
+		return
+	}
+
+	replayed := make(map[string]bool)
+	for _, m := range replay {
+		replayed[m.ID()] = true
+		q.queue = append(q.queue, queuedMessage{message: m})
+	}
+	for _, m := range held {
+		if m.broadcast.ID == "" || !replayed[m.broadcast.ID] {
+			q.queue = append(q.queue, m)
+		}
+	}
+	q.queue_lock.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default: // Already woken up
+	}
+}
+
+func (q *sendQueue) stop() {
+	q.stop_once.Do(func() {
+		close(q.quit)
+		if q.pending != "" {
+			q.server.untrackPending(q.pending)
+		}
+	})
+}
+
+// Stops the queue and returns what wasn't written, once the writer is done.
+func (q *sendQueue) drain() []ClientMessage {
+	q.stop()
+	<-q.done
+
+	q.queue_lock.Lock()
+	queued := q.queue
+	q.queue = nil
+	q.queue_lock.Unlock()
+	return q.convert(queued)
+}
+
+// Turns queued broadcasts into client messages, storing them as pending when
+// needed. Pending messages are stored in one go.
+func (q *sendQueue) convert(queued []queuedMessage) []ClientMessage {
+	broadcasts := make([]Message, 0)
+	for _, m := range queued {
+		if m.broadcast != nil {
+			broadcasts = append(broadcasts, *m.broadcast)
+		}
+	}
+	delivered := q.server.deliver(q.pending, broadcasts)
+
+	result := make([]ClientMessage, 0, len(queued))
+	for _, m := range queued {
+		if m.broadcast != nil {
+			result = append(result, delivered[0])
+			delivered = delivered[1:]
+		} else {
+			result = append(result, m.message)
+		}
+	}
+	return result
+}
+
+func (q *sendQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.wake:
+		case <-q.quit:
+			return
+		}
+
+		for {
+			// Take everything that's queued at once
+			q.queue_lock.Lock()
+			queued := q.queue
+			q.queue = nil
+			q.queue_lock.Unlock()
+			if len(queued) == 0 {
+				break
+			}
+
+			messages := q.convert(queued)
+			for i, msg := range messages {
+				err := q.write(msg)
+				if err != nil {
+					// Connection is gone, the reader will clean up.
+					// Put back what's left for it to drain.
+					left := make([]queuedMessage, 0, len(messages)-i)
+					for _, m := range messages[i:] {
+						left = append(left, queuedMessage{message: m})
+					}
+					q.queue_lock.Lock()
+					q.queue = append(left, q.queue...)
+					q.queue_lock.Unlock()
+					return
+				}
+			}
+		}
+	}
+}
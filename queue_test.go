@@ -0,0 +1,209 @@
+package broadcaster
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Queue with a writer that blocks on the first message until released.
+func testSendQueue(policy OverflowPolicy) (*Server, *sendQueue, chan ClientMessage, chan struct{}, chan bool) {
+	s := &Server{
+		SendQueueSize:  3,
+		OverflowPolicy: policy,
+	}
+
+	written := make(chan ClientMessage, 10)
+	release := make(chan struct{})
+	overflowed := make(chan bool, 1)
+	started := make(chan struct{})
+	first := true
+	q := newSendQueue(s, "token", "", func(m ClientMessage) error {
+		if first {
+			first = false
+			close(started)
+			<-release
+		}
+		written <- m
+		return nil
+	}, func() {
+		overflowed <- true
+	})
+
+	q.Send(Message{Channel: "test", Body: "0"})
+	<-started
+	for i := 1; i <= 5; i++ {
+		q.Send(Message{Channel: "test", Body: fmt.Sprintf("%d", i)})
+	}
+	return s, q, written, release, overflowed
+}
+
+func readQueued(t *testing.T, written chan ClientMessage, expected ...string) {
+	for _, body := range expected {
+		select {
+		case m := <-written:
+			if m.Body() != body {
+				t.Fatalf("Expected %#v, got %#v", body, m.Body())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timeout waiting for %#v", body)
+		}
+	}
+
+	select {
+	case m := <-written:
+		t.Fatalf("Unexpected message: %#v", m)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSendQueueDropOldest(t *testing.T) {
+	s, q, written, release, _ := testSendQueue(OverflowDropOldest)
+	defer q.stop()
+
+	close(release)
+	readQueued(t, written, "0", "3", "4", "5")
+	if s.metrics.dropped.Load() != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestSendQueueDropNewest(t *testing.T) {
+	s, q, written, release, _ := testSendQueue(OverflowDropNewest)
+	defer q.stop()
+
+	close(release)
+	readQueued(t, written, "0", "1", "2", "3")
+	if s.metrics.dropped.Load() != 2 {
+		t.Errorf("Expected 2 dropped messages, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestSendQueueDisconnect(t *testing.T) {
+	s, q, written, release, overflowed := testSendQueue(OverflowDisconnect)
+	defer q.stop()
+
+	select {
+	case <-overflowed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected overflow")
+	}
+
+	// Drops everything after overflowing
+	q.Notify(ClientMessage{"__type": "message", "channel": "test", "body": "6"})
+	close(release)
+	readQueued(t, written, "0", "1", "2", "3")
+	if s.metrics.dropped.Load() != 3 {
+		t.Errorf("Expected 3 dropped messages, got %d", s.metrics.dropped.Load())
+	}
+}
+
+func TestDispatcherBounded(t *testing.T) {
+	c := &Client{
+		HandlerQueueSize:      3,
+		HandlerOverflowPolicy: OverflowDropOldest,
+	}
+
+	written := make(chan ClientMessage, 10)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	first := true
+	d := newDispatcher(c, func(m Message) {
+		if first {
+			first = false
+			close(started)
+			<-release
+		}
+		written <- ClientMessage{"body": m.Body}
+	}, nil)
+	defer d.stop()
+
+	d.push(ClientMessage{"__type": "message", "channel": "test", "body": "0"})
+	<-started
+	for i := 1; i <= 5; i++ {
+		d.push(ClientMessage{"__type": "message", "channel": "test", "body": fmt.Sprintf("%d", i)})
+	}
+
+	close(release)
+	readQueued(t, written, "0", "3", "4", "5")
+}
+
+func TestSendQueueDropPending(t *testing.T) {
+	s := &Server{
+		SendQueueSize:  3,
+		OverflowPolicy: OverflowDropNewest,
+		Backend:        NewMemoryBackend(0),
+		AckTTL:         time.Minute,
+		RequireAck: func(channel string) bool {
+			return true
+		},
+	}
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	first := true
+	q := newSendQueue(s, "token", "pending", func(m ClientMessage) error {
+		if first {
+			first = false
+			close(started)
+			<-release
+		}
+		return nil
+	}, nil)
+	defer q.stop()
+	defer close(release)
+
+	q.Send(Message{Channel: "test", ID: "1"})
+	<-started
+	for i := 2; i <= 6; i++ {
+		q.Send(Message{Channel: "test", ID: fmt.Sprintf("%d", i)})
+	}
+
+	// Dropped messages are pending, so they get redelivered
+	for i := 0; ; i++ {
+		pending, err := s.Backend.GetPending([]string{"pending"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending["pending"]) == 3 {
+			break
+		}
+		if i == 20 {
+			t.Fatalf("Expected 3 pending messages, got %d", len(pending["pending"]))
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+}
+
+func TestSendQueueDrain(t *testing.T) {
+	s := &Server{
+		SendQueueSize: 3,
+	}
+
+	// Blocks until the queue is stopped, like a long-poll listener
+	var q *sendQueue
+	started := make(chan struct{})
+	q = newSendQueue(s, "token", "", func(m ClientMessage) error {
+		close(started)
+		<-q.quit
+		return errors.New("Connection closed")
+	}, nil)
+
+	q.Send(Message{Channel: "test", Body: "0"})
+	<-started
+	for i := 1; i <= 3; i++ {
+		q.Send(Message{Channel: "test", Body: fmt.Sprintf("%d", i)})
+	}
+
+	// Includes the message that failed to write
+	messages := q.drain()
+	if len(messages) != 4 {
+		t.Fatalf("Expected 4 messages, got %d", len(messages))
+	}
+	for i, m := range messages {
+		if m.Body() != fmt.Sprintf("%d", i) {
+			t.Errorf("Unexpected message %d: %#v", i, m)
+		}
+	}
+}
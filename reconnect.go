@@ -0,0 +1,223 @@
+package broadcaster
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// A ReconnectPolicy controls how a Client reconnects after losing its
+// connection. The first attempt is made right away, after that the delay
+// grows exponentially.
+type ReconnectPolicy struct {
+	// Delay before the second attempt (defaults to 1 second)
+	InitialDelay time.Duration
+
+	// Upper bound for the delay (defaults to 30 seconds)
+	MaxDelay time.Duration
+
+	// Factor by which the delay grows after each attempt (defaults to 2)
+	Multiplier float64
+
+	// Fraction of the delay that is randomized, between 0 and 1. Spreads
+	// out reconnecting clients after a server restart.
+	Jitter float64
+
+	// Number of attempts before giving up, 0 to not reconnect at all and
+	// UnlimitedAttempts to keep trying forever
+	MaxAttempts int
+
+	// Called before each attempt, with the delay that precedes it
+	OnReconnecting func(attempt int, delay time.Duration)
+
+	// Called once reconnected, with the outcome of resubscribing to each
+	// channel and pattern
+	OnReconnected func(attempt int, results []ResubscribeResult)
+
+	// Called when giving up, with the error of the last attempt
+	OnGiveUp func(err error)
+}
+
+// UnlimitedAttempts can be used as MaxAttempts to never give up reconnecting.
+const UnlimitedAttempts = -1
+
+// ResubscribeResult holds the outcome of resubscribing to a channel or
+// pattern after reconnecting.
+type ResubscribeResult struct {
+	Channel string
+
+	// Set for pattern subscriptions
+	Pattern bool
+
+	// Nil when resubscribed
+	Err error
+}
+
+func (c *Client) reconnectPolicy() *ReconnectPolicy {
+	if c.Reconnect != nil {
+		return c.Reconnect
+	}
+	return &ReconnectPolicy{
+		Jitter:      0.2,
+		MaxAttempts: c.MaxAttempts,
+	}
+}
+
+// Delay before the given attempt, starting at 1.
+func (p *ReconnectPolicy) delay(attempt int) time.Duration {
+	if attempt <= 1 {
+		return 0
+	}
+
+	initial := p.InitialDelay
+	if initial == 0 {
+		initial = 1 * time.Second
+	}
+	max := p.MaxDelay
+	if max == 0 {
+		max = 30 * time.Second
+	}
+	multiplier := p.Multiplier
+	if multiplier == 0 {
+		multiplier = 2
+	}
+
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(attempt-2)), float64(max))
+	if p.Jitter > 0 {
+		d -= d * math.Min(p.Jitter, 1) * rand.Float64()
+	}
+	return time.Duration(d)
+}
+
+// Called when a transport fails. Reconnects according to the policy, unless
+// we're disconnecting or another failure already took care of it.
+func (c *Client) disconnected(failed clientTransport) {
+	if c.should_disconnect.Load() {
+		return
+	}
+
+	c.reconnect_lock.Lock()
+	defer c.reconnect_lock.Unlock()
+
+	if c.should_disconnect.Load() || c.getTransport() != failed {
+		return
+	}
+	failed.Close()
+	c.setState(ClientStateReconnecting)
+
+	// Give up on Disconnect()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.quit:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	policy := c.reconnectPolicy()
+	var err error
+	for attempt := 1; policy.MaxAttempts < 0 || attempt <= policy.MaxAttempts; attempt++ {
+		delay := policy.delay(attempt)
+		if policy.OnReconnecting != nil {
+			policy.OnReconnecting(attempt, delay)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return
+		}
+
+		var results []ResubscribeResult
+		results, err = c.connect(ctx)
+		if err == nil {
+			if policy.OnReconnected != nil {
+				policy.OnReconnected(attempt, results)
+			}
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+
+	c.should_disconnect.Store(true)
+	c.Error = errors.New("Disconnected")
+	c.setState(ClientStateClosed)
+	if policy.OnGiveUp != nil {
+		policy.OnGiveUp(err)
+	}
+
+	select {
+	case c.Disconnected <- true:
+	case <-c.quit:
+	}
+}
+
+// Restores the subscriptions after reconnecting. Channels are resubscribed in
+// one go, resuming where we left off.
+func (c *Client) resubscribe(ctx context.Context, previous string) ([]ResubscribeResult, error) {
+	c.channels_lock.Lock()
+	toSubscribe := make([]string, 0)
+	signatures := make(map[string]ClientMessage)
+	for channel, subscribed := range c.channels {
+		if subscribed {
+			toSubscribe = append(toSubscribe, channel)
+		}
+		if s, ok := c.signatures[channel]; ok {
+			signatures[channel] = s
+		}
+	}
+	toPSubscribe := make([]string, 0)
+	for pattern, subscribed := range c.patterns {
+		if subscribed {
+			toPSubscribe = append(toPSubscribe, pattern)
+		}
+	}
+	c.channels_lock.Unlock()
+
+	results := make([]ResubscribeResult, 0, len(toSubscribe)+len(toPSubscribe))
+	if len(toSubscribe) > 0 {
+		entries := make([]ClientMessage, 0, len(toSubscribe))
+		for _, channel := range toSubscribe {
+			entry := ClientMessage{"channel": channel}
+			if id := c.LastID(channel); id != "" {
+				SubscribeSince(id)(entry)
+			}
+			if previous != "" {
+				entry["resume"] = previous
+			}
+			for k, v := range signatures[channel] {
+				entry[k] = v
+			}
+			entries = append(entries, entry)
+		}
+
+		failed, err := c.subscribeMany(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range toSubscribe {
+			results = append(results, ResubscribeResult{
+				Channel: channel,
+				Err:     failed[channel],
+			})
+		}
+	}
+	for _, pattern := range toPSubscribe {
+		m, err := c.callContext(ctx, PSubscribeMessage, ClientMessage{"channel": pattern})
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, ResubscribeResult{
+			Channel: pattern,
+			Pattern: true,
+			Err:     c.psubscribeResult(pattern, m),
+		})
+	}
+	return results, nil
+}
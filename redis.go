@@ -3,7 +3,11 @@ package broadcaster
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,7 +31,18 @@ type redisBackend struct {
 	subscriptions     map[string]bool
 	subscriptionsLock sync.Mutex
 
-	Messages chan redis.Message
+	// Pattern subscriptions use their own connection, see PSubscribe.
+	patterns      map[string]bool
+	patternsLock  sync.Mutex
+	patternConn   *redis.PubSubConn
+	patternListen sync.Once
+	closed        *atomic.Bool
+
+	// Number of times the pub/sub connections were made, for metrics
+	pubSubDials  *atomic.Int64
+	patternDials *atomic.Int64
+
+	messages chan BackendMessage
 }
 
 const (
@@ -77,8 +92,12 @@ func newRedisBackend(redisHost, pubSubHost, controlChannel, prefix string, timeo
 		timeout:        int(timeout.Seconds()) + 1,
 		controlChannel: controlChannel,
 		subscriptions:  make(map[string]bool),
-		Messages:       make(chan redis.Message, 250),
+		patterns:       make(map[string]bool),
+		messages:       make(chan BackendMessage, 250),
 		listening:      atomic.NewBool(false),
+		closed:         atomic.NewBool(false),
+		pubSubDials:    atomic.NewInt64(0),
+		patternDials:   atomic.NewInt64(0),
 	}
 	b.controlWait.Add(1)
 
@@ -95,19 +114,46 @@ func (b *redisBackend) listen() {
 		if !ok {
 			return
 		}
-		b.Messages <- msg
+
+		if strings.HasPrefix(msg.Channel, b.key("msg:")) {
+			m := Message{}
+			err := json.Unmarshal(msg.Data, &m)
+			if err != nil {
+				continue
+			}
+			b.messages <- BackendMessage{
+				Channel: m.Channel,
+				Data:    []byte(m.Body),
+				ID:      m.ID,
+				Time:    m.Time,
+			}
+			continue
+		}
+
+		b.messages <- BackendMessage{
+			Channel: msg.Channel,
+			Data:    msg.Data,
+			Control: msg.Channel == b.controlChannel,
+			Time:    time.Now(),
+		}
 	}
 }
 
+func (b *redisBackend) Messages() <-chan BackendMessage {
+	return b.messages
+}
+
 func (b *redisBackend) connect() {
 	b.listening.Store(false)
 
-	b.pubSub = rrpubsub.New(context.Background(), "tcp", b.pubSubHost, b.dialOptions...)
+	opts := append([]redis.DialOption{}, b.dialOptions...)
+	opts = append(opts, countDials(b.pubSubDials))
+	b.pubSub = rrpubsub.New(context.Background(), "tcp", b.pubSubHost, opts...)
 	b.pubSub.Subscribe(b.controlChannel)
 
 	b.subscriptionsLock.Lock()
 	for k, _ := range b.subscriptions {
-		b.pubSub.Subscribe(k)
+		b.pubSub.Subscribe(k, b.key("msg:%s", k))
 	}
 	b.subscriptionsLock.Unlock()
 
@@ -160,12 +206,36 @@ func (b *redisBackend) StoreSession(token string, auth ClientMessage) error {
 	return err
 }
 
+func (b *redisBackend) UpdateSession(token string, auth ClientMessage) error {
+	delete(auth, "__token")
+	delete(auth, "__type")
+	data, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	// Only if it still exists, keeps the connected count right
+	reply, err := conn.Do("SET", b.key("sess:"+token), string(data), "EX", b.timeout, "XX")
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return errors.New("Unknown session")
+	}
+	return nil
+}
+
 func (b *redisBackend) DeleteSession(token string) error {
 	conn := b.conn.Get()
 	defer conn.Close()
 	conn.Send("MULTI")
 	conn.Send("DEL", b.key("sess:%s", token))
 	conn.Send("DEL", b.key("channels:%s", token))
+	conn.Send("DEL", b.key("patterns:%s", token))
+	conn.Send("DEL", b.key("cursor:%s", token))
 	conn.Send("DECR", b.key("connected"))
 	_, err := conn.Do("EXEC")
 	return err
@@ -205,7 +275,7 @@ func (b *redisBackend) Subscribe(channel string) {
 	b.subscriptionsLock.Lock()
 	defer b.subscriptionsLock.Unlock()
 	b.subscriptions[channel] = true
-	b.pubSub.Subscribe(channel)
+	b.pubSub.Subscribe(channel, b.key("msg:%s", channel))
 }
 
 func (b *redisBackend) Unsubscribe(channel string) {
@@ -213,41 +283,492 @@ func (b *redisBackend) Unsubscribe(channel string) {
 	b.subscriptionsLock.Lock()
 	defer b.subscriptionsLock.Unlock()
 	delete(b.subscriptions, channel)
-	b.pubSub.Unsubscribe(channel)
+	b.pubSub.Unsubscribe(channel, b.key("msg:%s", channel))
+}
+
+// Counts the connections rrpubsub makes, it reconnects by itself.
+func countDials(dials *atomic.Int64) redis.DialOption {
+	return redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, addr, redisConnectTimeout)
+		if err == nil {
+			dials.Inc()
+		}
+		return conn, err
+	})
+}
+
+// Number of times a connection was made again, after the first time.
+func reconnects(dials *atomic.Int64) int64 {
+	n := dials.Load()
+	if n == 0 {
+		return 0
+	}
+	return n - 1
+}
+
+// Pattern subscriptions aren't supported by rrpubsub, so these are handled on
+// a separate connection, which is only opened once a pattern is used.
+func (b *redisBackend) PSubscribe(pattern string) {
+	b.patternListen.Do(func() {
+		go b.listenPatterns()
+	})
+
+	b.patternsLock.Lock()
+	defer b.patternsLock.Unlock()
+	b.patterns[pattern] = true
+	if b.patternConn != nil {
+		b.patternConn.PSubscribe(pattern, b.patternKey(pattern))
+	}
+}
+
+func (b *redisBackend) PUnsubscribe(pattern string) {
+	b.patternsLock.Lock()
+	defer b.patternsLock.Unlock()
+	delete(b.patterns, pattern)
+	if b.patternConn != nil {
+		b.patternConn.PUnsubscribe(pattern, b.patternKey(pattern))
+	}
+}
+
+// Pattern that matches the wrapped messages of a Server.
+func (b *redisBackend) patternKey(pattern string) string {
+	return globEscape(b.key("msg:")) + pattern
+}
+
+func (b *redisBackend) listenPatterns() {
+	for !b.closed.Load() {
+		conn, err := redis.Dial("tcp", b.pubSubHost, b.dialOptions...)
+		if err != nil {
+			time.Sleep(redisSleep)
+			continue
+		}
+		b.patternDials.Inc()
+		psc := &redis.PubSubConn{Conn: conn}
+
+		b.patternsLock.Lock()
+		b.patternConn = psc
+		for k, _ := range b.patterns {
+			psc.PSubscribe(k, b.patternKey(k))
+		}
+		b.patternsLock.Unlock()
+
+		done := make(chan struct{})
+		go b.pingPatterns(psc, done)
+		b.receivePatterns(psc)
+		close(done)
+
+		b.patternsLock.Lock()
+		b.patternConn = nil
+		b.patternsLock.Unlock()
+		conn.Close()
+	}
+}
+
+// Keeps the pattern connection from hitting the read timeout
+func (b *redisBackend) pingPatterns(psc *redis.PubSubConn, done chan struct{}) {
+	for {
+		select {
+		case <-time.After(redisPingInterval):
+		case <-done:
+			return
+		}
+
+		b.patternsLock.Lock()
+		err := psc.Ping("")
+		b.patternsLock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (b *redisBackend) receivePatterns(psc *redis.PubSubConn) {
+	prefix := globEscape(b.key("msg:"))
+	for {
+		switch msg := psc.Receive().(type) {
+		case error:
+			return
+		case redis.Message:
+			if strings.HasPrefix(msg.Pattern, prefix) {
+				m := Message{}
+				err := json.Unmarshal(msg.Data, &m)
+				if err != nil {
+					continue
+				}
+				b.messages <- BackendMessage{
+					Channel: m.Channel,
+					Pattern: strings.TrimPrefix(msg.Pattern, prefix),
+					Data:    []byte(m.Body),
+					ID:      m.ID,
+					Time:    m.Time,
+				}
+				continue
+			}
+
+			// Raw patterns can also match our own channels, skip those.
+			if msg.Channel == b.controlChannel || strings.HasPrefix(msg.Channel, b.key("msg:")) {
+				continue
+			}
+
+			b.messages <- BackendMessage{
+				Channel: msg.Channel,
+				Pattern: msg.Pattern,
+				Data:    msg.Data,
+				Time:    time.Now(),
+			}
+		}
+	}
+}
+
+// Messages published through a Server are wrapped to include their id and
+// are sent on a separate channel, to distinguish them from messages that are
+// published directly on Redis.
+func (b *redisBackend) Publish(m Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", b.key("msg:%s", m.Channel), data)
+	return err
+}
+
+func (b *redisBackend) NextID(channel string, ttl time.Duration) (string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("seq:%s", channel)
+	conn.Send("MULTI")
+	conn.Send("INCR", key)
+	conn.Send("EXPIRE", key, int(ttl.Seconds())+1)
+	result, err := redis.Values(conn.Do("EXEC"))
+	if err != nil {
+		return "", err
+	}
+	id, err := redis.Int64(result[0], nil)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(id, 10), nil
+}
+
+func (b *redisBackend) StoreHistory(channel string, m Message, length int, ttl time.Duration) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("history:%s", channel)
+	conn.Send("MULTI")
+	conn.Send("RPUSH", key, data)
+	conn.Send("LTRIM", key, -length, -1)
+	conn.Send("EXPIRE", key, int(ttl.Seconds())+1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) GetHistory(channel string) ([]Message, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	entries, err := redis.ByteSlices(conn.Do("LRANGE", b.key("history:%s", channel), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Message, 0, len(entries))
+	for _, v := range entries {
+		m := Message{}
+		err := json.Unmarshal(v, &m)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func (b *redisBackend) Notify(channel string, m ClientMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", b.controlChannel, fmt.Sprintf("notify %s %s", channel, data))
+	return err
+}
+
+// Presence entries are kept in a hash, along with a sorted set that holds
+// when each of them expires.
+func (b *redisBackend) AddPresence(channel string, p PresenceEntry, ttl time.Duration) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("presence:%s", channel)
+	expiry := b.key("presence-expiry:%s", channel)
+	conn.Send("MULTI")
+	conn.Send("HSET", key, p.ID, data)
+	conn.Send("ZADD", expiry, time.Now().Add(ttl).Unix(), p.ID)
+	conn.Send("EXPIRE", key, int(ttl.Seconds())+1)
+	conn.Send("EXPIRE", expiry, int(ttl.Seconds())+1)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) RemovePresence(channel, id string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HDEL", b.key("presence:%s", channel), id)
+	conn.Send("ZREM", b.key("presence-expiry:%s", channel), id)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) RefreshPresence(channel string, ids []string, ttl time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("presence:%s", channel)
+	expiry := b.key("presence-expiry:%s", channel)
+	expires := time.Now().Add(ttl).Unix()
+	args := redis.Args{}.Add(expiry, "XX")
+	for _, id := range ids {
+		args = args.Add(expires, id)
+	}
+	conn.Send("MULTI")
+	conn.Send("ZADD", args...)
+	conn.Send("EXPIRE", key, int(ttl.Seconds())+1)
+	conn.Send("EXPIRE", expiry, int(ttl.Seconds())+1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) GetPresence(channel string) ([]PresenceEntry, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("presence:%s", channel)
+	expiry := b.key("presence-expiry:%s", channel)
+	now := time.Now().Unix()
+
+	// Clean up entries that weren't refreshed in time
+	expired, err := redis.Strings(conn.Do("ZRANGEBYSCORE", expiry, "-inf", fmt.Sprintf("(%d", now)))
+	if err != nil {
+		return nil, err
+	}
+	if len(expired) > 0 {
+		conn.Send("MULTI")
+		conn.Send("HDEL", redis.Args{}.Add(key).AddFlat(expired)...)
+		conn.Send("ZREM", redis.Args{}.Add(expiry).AddFlat(expired)...)
+		_, err = conn.Do("EXEC")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]PresenceEntry, 0, len(entries))
+	for _, v := range entries {
+		p := PresenceEntry{}
+		err := json.Unmarshal([]byte(v), &p)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, p)
+	}
+	return result, nil
+}
+
+func (b *redisBackend) AddPending(key string, messages []PendingMessage, ttl time.Duration) error {
+	args := redis.Args{}.Add(b.key("pending:%s", key))
+	for _, m := range messages {
+		data, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		args = args.Add(pendingField(m.Channel, m.ID), data)
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	conn.Send("MULTI")
+	conn.Send("HSET", args...)
+	conn.Send("EXPIRE", args[0], int(ttl.Seconds())+1)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) RemovePending(key, channel, id string) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", b.key("pending:%s", key), pendingField(channel, id))
+	return err
+}
+
+// Fetches all keys in a single round trip.
+func (b *redisBackend) GetPending(keys []string) (map[string][]PendingMessage, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	for _, key := range keys {
+		conn.Send("HVALS", b.key("pending:%s", key))
+	}
+	err := conn.Flush()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]PendingMessage)
+	for _, key := range keys {
+		entries, err := redis.ByteSlices(conn.Receive())
+		if err != nil {
+			return nil, err
+		}
+
+		messages := make([]PendingMessage, 0, len(entries))
+		for _, v := range entries {
+			m := PendingMessage{}
+			err := json.Unmarshal(v, &m)
+			if err != nil {
+				return nil, err
+			}
+			messages = append(messages, m)
+		}
+		result[key] = messages
+	}
+	return result, nil
+}
+
+func (b *redisBackend) StoreNodeStats(stats NodeStats, ttl time.Duration) error {
+	data, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+
+	conn := b.conn.Get()
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("SADD", b.key("nodes"), stats.NodeID)
+	conn.Send("SETEX", b.key("node:%s", stats.NodeID), int(ttl.Seconds())+1, data)
+	_, err = conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) GetNodeStats() ([]NodeStats, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	nodes, err := redis.Strings(conn.Do("SMEMBERS", b.key("nodes")))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]NodeStats, 0, len(nodes))
+	for _, node := range nodes {
+		data, err := redis.Bytes(conn.Do("GET", b.key("node:%s", node)))
+		if err == redis.ErrNil {
+			// Expired, node is gone
+			conn.Do("SREM", b.key("nodes"), node)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		stats := NodeStats{}
+		err = json.Unmarshal(data, &stats)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, stats)
+	}
+	return result, nil
 }
 
 // Records channel subscription and broadcasts it to listeners
 func (b *redisBackend) LongpollSubscribe(token, channel string) error {
+	return b.longpollAdd("channels", "subscribe", token, channel)
+}
+
+// Records channel unsubscription and broadcasts it to listeners
+func (b *redisBackend) LongpollUnsubscribe(token, channel string) error {
+	return b.longpollRemove("channels", "unsubscribe", token, channel)
+}
+
+func (b *redisBackend) LongpollGetChannels(token string) ([]string, error) {
+	return b.longpollList("channels", token)
+}
+
+// Records pattern subscription and broadcasts it to listeners
+func (b *redisBackend) LongpollPSubscribe(token, pattern string) error {
+	return b.longpollAdd("patterns", "psubscribe", token, pattern)
+}
+
+// Records pattern unsubscription and broadcasts it to listeners
+func (b *redisBackend) LongpollPUnsubscribe(token, pattern string) error {
+	return b.longpollRemove("patterns", "punsubscribe", token, pattern)
+}
+
+func (b *redisBackend) LongpollGetPatterns(token string) ([]string, error) {
+	return b.longpollList("patterns", token)
+}
+
+func (b *redisBackend) longpollAdd(set, command, token, channel string) error {
 	conn := b.conn.Get()
 	defer conn.Close()
 
-	key := b.key("channels:%s", token)
+	key := b.key("%s:%s", set, token)
 	conn.Send("MULTI")
 	conn.Send("HSET", key, channel, "1")
 	conn.Send("EXPIRE", key, b.timeout)
-	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("subscribe %s %s", token, channel))
+	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("%s %s %s", command, token, channel))
 	_, err := conn.Do("EXEC")
 	return err
 }
 
-// Records channel unsubscription and broadcasts it to listeners
-func (b *redisBackend) LongpollUnsubscribe(token, channel string) error {
+func (b *redisBackend) longpollRemove(set, command, token, channel string) error {
 	conn := b.conn.Get()
 	defer conn.Close()
 
-	key := b.key("channels:%s", token)
+	key := b.key("%s:%s", set, token)
 	conn.Send("MULTI")
 	conn.Send("HDEL", key, channel)
-	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("unsubscribe %s %s", token, channel))
+	conn.Send("PUBLISH", b.controlChannel, fmt.Sprintf("%s %s %s", command, token, channel))
 	_, err := conn.Do("EXEC")
 	return err
 }
 
-func (b *redisBackend) LongpollGetChannels(token string) ([]string, error) {
+func (b *redisBackend) longpollList(set, token string) ([]string, error) {
 	conn := b.conn.Get()
 	defer conn.Close()
 
-	key := b.key("channels:%s", token)
+	key := b.key("%s:%s", set, token)
 
 	return redis.Strings(conn.Do("HKEYS", key))
 }
@@ -260,6 +781,7 @@ func (b *redisBackend) LongpollPing(token string) error {
 	// allowed lingering time.
 	conn.Send("MULTI")
 	conn.Send("EXPIRE", b.key("channels:%s", token), b.timeout*2)
+	conn.Send("EXPIRE", b.key("patterns:%s", token), b.timeout*2)
 	conn.Send("EXPIRE", b.key("sess:%s", token), b.timeout*2)
 	_, err := conn.Do("EXEC")
 	return err
@@ -269,8 +791,6 @@ func (b *redisBackend) LongpollBacklog(token string, m ClientMessage) error {
 	conn := b.conn.Get()
 	defer conn.Close()
 
-	// No need to store type
-	delete(m, "__type")
 	data, err := json.Marshal(m)
 	if err != nil {
 		return err
@@ -292,6 +812,30 @@ func (b *redisBackend) LongpollTransfer(token string, seq string) error {
 	return err
 }
 
+func (b *redisBackend) LongpollStoreCursor(token string, fields map[string]string, reset bool) error {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	key := b.key("cursor:%s", token)
+	conn.Send("MULTI")
+	if reset {
+		conn.Send("DEL", key)
+	}
+	if len(fields) > 0 {
+		conn.Send("HSET", redis.Args{}.Add(key).AddFlat(fields)...)
+	}
+	conn.Send("EXPIRE", key, b.timeout*2)
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (b *redisBackend) LongpollGetCursor(token string) (map[string]string, error) {
+	conn := b.conn.Get()
+	defer conn.Close()
+
+	return redis.StringMap(conn.Do("HGETALL", b.key("cursor:%s", token)))
+}
+
 func (b *redisBackend) LongpollGetBacklog(token string, result chan ClientMessage) {
 	conn := b.conn.Get()
 	defer conn.Close()
@@ -309,7 +853,9 @@ func (b *redisBackend) LongpollGetBacklog(token string, result chan ClientMessag
 			return
 		}
 
-		data["__type"] = MessageMessage
+		if data.Type() == "" {
+			data["__type"] = MessageMessage
+		}
 
 		result <- data
 	}
@@ -318,3 +864,26 @@ func (b *redisBackend) LongpollGetBacklog(token string, result chan ClientMessag
 func (b *redisBackend) IsListening() bool {
 	return b.listening.Load()
 }
+
+func (b *redisBackend) Close() error {
+	if b.closed.Load() {
+		return nil
+	}
+	b.controlWait.Wait()
+	b.listening.Store(false)
+
+	if b.closed.Swap(true) {
+		return nil
+	}
+	b.patternsLock.Lock()
+	if b.patternConn != nil {
+		b.patternConn.Close()
+	}
+	b.patternsLock.Unlock()
+
+	err := b.pubSub.Close()
+	if err != nil {
+		return err
+	}
+	return b.conn.Close()
+}
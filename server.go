@@ -1,10 +1,19 @@
 package broadcaster
 
 import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"runtime"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pborman/uuid"
+	"go.uber.org/atomic"
 )
 
 // A Server is the main class of this package, pass it to http.Handle on a
@@ -17,6 +26,36 @@ type Server struct {
 	// for channels.
 	CanSubscribe func(data map[string]interface{}, channel string) bool
 
+	// Invoked upon pattern subscription, with the pattern. Clients cannot
+	// subscribe to patterns when neither this nor AuthorizePSubscribe is set.
+	CanPSubscribe func(data map[string]interface{}, pattern string) bool
+
+	// Invoked when a client publishes a message, can be used to enforce
+	// access control. Clients cannot publish when this is not set.
+	CanPublish func(data map[string]interface{}, channel, body string) bool
+
+	// Authenticates clients, returning their identity. CanConnect is not
+	// used when this is set.
+	Authenticator Authenticator
+
+	// Like CanSubscribe, with the identity returned by the Authenticator
+	// (nil when not set). Both are checked when set. Defaults to the
+	// Authenticator, if it's a SubscribeAuthorizer.
+	AuthorizeSubscribe func(identity *Identity, channel string) bool
+
+	// Like CanPSubscribe, with the identity returned by the Authenticator
+	// (nil when not set). Both are checked when set. Defaults to the
+	// Authenticator, if it's a PSubscribeAuthorizer.
+	AuthorizePSubscribe func(identity *Identity, pattern string) bool
+
+	// Like CanPublish, with the identity returned by the Authenticator
+	// (nil when not set). Both are checked when set.
+	AuthorizePublish func(identity *Identity, channel, body string) bool
+
+	// Key for signed channel subscriptions, see SignChannel. Disabled when
+	// not set.
+	ChannelSecret []byte
+
 	// Can be set to allow CORS requests.
 	CheckOrigin func(r *http.Request) bool
 
@@ -24,6 +63,25 @@ type Server struct {
 	// See http://godoc.org/github.com/gorilla/websocket#Upgrader
 	Upgrader websocket.Upgrader
 
+	// Compresses messages: negotiates permessage-deflate with websocket
+	// clients that support it and gzips long-poll replies for clients that
+	// accept it.
+	EnableCompression bool
+
+	// Compression level, see compress/flate. Defaults to
+	// flate.DefaultCompression.
+	CompressionLevel int
+
+	// Messages smaller than this many bytes are sent uncompressed
+	CompressionThreshold int
+
+	// Wire formats clients may pick instead of JSON, see Client.Codec.
+	// Only JSON is used unless this is set, e.g. to []Codec{MessagePack}.
+	Codecs []Codec
+
+	// Largest message accepted from clients, in bytes. Defaults to 1 MiB
+	MaxMessageSize int64
+
 	// Redis host, used for data, defaults to localhost:6379
 	RedisHost string
 
@@ -44,9 +102,80 @@ type Server struct {
 	// Combine long poll message for given duration (more latency, less load)
 	PollTime time.Duration
 
-	redis    *redisBackend
+	// Timeout for writes to websocket connections, defaults to 10 seconds
+	WriteTimeout time.Duration
+
+	// Enables presence tracking for a channel, see Presence()
+	TrackPresence func(channel string) bool
+
+	// Auth data fields that are stored in presence entries
+	PresenceFields []string
+
+	// Sends join and leave messages to subscribers of channels that track
+	// presence
+	PresenceEvents bool
+
+	// Number of messages kept per channel, to replay for clients that
+	// subscribe with a since option. Disabled when 0.
+	HistoryLength int
+
+	// How long history is kept, defaults to 1 hour
+	HistoryTTL time.Duration
+
+	// Can be used to only keep history for some channels
+	KeepHistory func(channel string) bool
+
+	// Channels on which clients have to acknowledge messages. Messages that
+	// aren't acknowledged are redelivered after AckTimeout or when the
+	// client reconnects. Disabled for all channels when not set.
+	RequireAck func(channel string) bool
+
+	// Time after which unacknowledged messages are redelivered, defaults
+	// to 30 seconds
+	AckTimeout time.Duration
+
+	// How long unacknowledged messages are kept, defaults to 1 hour
+	AckTTL time.Duration
+
+	// Identifies this node in ClusterStats, defaults to a random id
+	NodeID string
+
+	// How often node stats are published, defaults to 10 seconds
+	StatsInterval time.Duration
+
+	// Number of messages queued per connection while the client catches
+	// up, defaults to 100
+	SendQueueSize int
+
+	// What to do when the send queue of a connection is full, defaults to
+	// OverflowDropOldest
+	OverflowPolicy OverflowPolicy
+
+	// Close code used for websocket connections with OverflowDisconnect,
+	// defaults to 4429
+	OverflowCloseCode int
+
+	// Number of hub workers, channels are partitioned across them. Defaults
+	// to GOMAXPROCS.
+	HubShards int
+
+	// Storage and pub/sub backend, defaults to Redis (configured with the
+	// fields above)
+	Backend Backend
+
 	hub      *hub
+	metrics  metrics
 	prepared bool
+
+	// Shutdown handling
+	closing      *atomic.Bool
+	closing_lock sync.Mutex
+	quit         chan struct{}
+	active       sync.WaitGroup
+
+	// Pending keys of local connections, for redelivery
+	pending_keys map[string]*pendingOwner
+	pending_lock sync.Mutex
 }
 
 func (s *Server) Prepare() error {
@@ -69,27 +198,81 @@ func (s *Server) Prepare() error {
 	if s.PollTime == 0 {
 		s.PollTime = 500 * time.Millisecond
 	}
+	if s.WriteTimeout == 0 {
+		s.WriteTimeout = 10 * time.Second
+	}
+	if s.HistoryTTL == 0 {
+		s.HistoryTTL = 1 * time.Hour
+	}
+	if s.AckTimeout == 0 {
+		s.AckTimeout = 30 * time.Second
+	}
+	if s.AckTTL == 0 {
+		s.AckTTL = 1 * time.Hour
+	}
+	if s.NodeID == "" {
+		s.NodeID = uuid.New()
+	}
+	if s.StatsInterval == 0 {
+		s.StatsInterval = 10 * time.Second
+	}
+	if s.HubShards == 0 {
+		s.HubShards = runtime.GOMAXPROCS(0)
+	}
+	if s.SendQueueSize == 0 {
+		s.SendQueueSize = 100
+	}
+	if s.OverflowCloseCode == 0 {
+		s.OverflowCloseCode = 4429
+	}
 
 	if s.Upgrader.CheckOrigin == nil && s.CheckOrigin != nil {
 		s.Upgrader.CheckOrigin = s.CheckOrigin
 	}
 
-	redis, err := newRedisBackend(s.RedisHost, s.PubSubHost, s.ControlChannel, s.ControlNamespace, s.Timeout)
-	if err != nil {
-		return err
+	if s.CompressionLevel == 0 {
+		s.CompressionLevel = flate.DefaultCompression
+	}
+	if s.CompressionLevel < flate.HuffmanOnly || s.CompressionLevel > flate.BestCompression {
+		return fmt.Errorf("Invalid compression level: %d", s.CompressionLevel)
+	}
+	if s.EnableCompression {
+		s.Upgrader.EnableCompression = true
+	}
+	if s.MaxMessageSize == 0 {
+		s.MaxMessageSize = 1 << 20
+	}
+	if a, ok := s.Authenticator.(SubscribeAuthorizer); ok && s.AuthorizeSubscribe == nil {
+		s.AuthorizeSubscribe = a.CanSubscribe
 	}
-	s.redis = redis
+	if a, ok := s.Authenticator.(PSubscribeAuthorizer); ok && s.AuthorizePSubscribe == nil {
+		s.AuthorizePSubscribe = a.CanPSubscribe
+	}
+
+	if s.Backend == nil {
+		redis, err := newRedisBackend(s.RedisHost, s.PubSubHost, s.ControlChannel, s.ControlNamespace, s.Timeout)
+		if err != nil {
+			return err
+		}
+		s.Backend = redis
+	}
+
+	s.closing = atomic.NewBool(false)
+	s.quit = make(chan struct{})
 
 	s.hub = &hub{
-		redis: redis,
+		backend:    s.Backend,
+		shardCount: s.HubShards,
 	}
 
-	err = s.hub.Prepare()
+	err := s.hub.Prepare()
 	if err != nil {
 		return err
 	}
 
 	go s.hub.Run()
+	go s.runHeartbeat()
+	go s.runRedelivery()
 	s.prepared = true
 	return nil
 }
@@ -101,6 +284,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if s.closing.Load() {
+		http.Error(w, "Server shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
 	if s.CheckOrigin != nil && s.CheckOrigin(r) {
 		origin := r.Header.Get("Origin")
 		w.Header().Set("Access-Control-Allow-Origin", origin)
@@ -109,9 +297,11 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	if r.Method == "GET" {
 		if r.URL.Path == "/health" {
-			if !s.redis.IsListening() {
-				http.Error(w, "No connection to redis", http.StatusServiceUnavailable)
+			if !s.Backend.IsListening() {
+				http.Error(w, "No connection to backend", http.StatusServiceUnavailable)
 			}
+		} else if isEventStream(r) {
+			s.handleSSE(w, r)
 		} else {
 			s.handleWebsocket(w, r)
 		}
@@ -120,24 +310,142 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Shutdown gracefully stops the server: new connections are refused,
+// websocket clients are closed with a "going away" code and long-polling
+// clients are told to reconnect. Once all connections are cleaned up (or the
+// context expires), the backend is closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if !s.prepared {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+	s.closing_lock.Lock()
+	if s.closing.Swap(true) {
+		s.closing_lock.Unlock()
+		return errors.New("Server already shut down")
+	}
+	s.closing_lock.Unlock()
+
+	// Connections registered from now on are refused, all others are in
+	// here. Closing them can take a while with slow clients, so that's
+	// bound by ctx as well.
+	done := make(chan struct{})
+	go func() {
+		s.hub.Shutdown()
+		s.active.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	close(s.quit)
+	s.hub.Stop()
+
+	closeErr := s.Backend.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Adds a connection to the hub and tracks it until it's cleaned up, which
+// calls active.Done(). Refused once shutting down.
+func (s *Server) register(conn connection) error {
+	s.closing_lock.Lock()
+	defer s.closing_lock.Unlock()
+
+	if s.closing.Load() {
+		return errors.New("Server shutting down")
+	}
+	err := s.hub.Connect(conn)
+	if err != nil {
+		return err
+	}
+	s.active.Add(1)
+	return nil
+}
+
 func (s *Server) handleWebsocket(w http.ResponseWriter, r *http.Request) {
 	// Always a new client, easy!
 	newWebsocketConnection(w, r, s)
 }
 
+func (s *Server) handleSSE(w http.ResponseWriter, r *http.Request) {
+	err := handleSSEConnection(w, r, s)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
 func (s *Server) handleLongPoll(w http.ResponseWriter, r *http.Request) {
+	if s.EnableCompression && acceptsGzip(r) {
+		gw := newGzipResponseWriter(w, s.CompressionLevel, s.CompressionThreshold)
+		defer gw.Close()
+		w = gw
+	}
+
 	err := handleLongpollConnection(w, r, s)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// Publish sends a message to all clients subscribed to the given channel, on
+// all nodes.
+func (s *Server) Publish(channel, message string) error {
+	if !s.prepared {
+		return errors.New("Prepare() not called on broadcaster.Server")
+	}
+
+	// Ids outlive the history, so replays never mix up sequences
+	id, err := s.Backend.NextID(channel, s.HistoryTTL)
+	if err != nil {
+		return err
+	}
+
+	m := Message{
+		Channel: channel,
+		Body:    message,
+		ID:      id,
+		Time:    time.Now(),
+	}
+
+	err = s.storeHistory(m)
+	if err != nil {
+		return err
+	}
+
+	return s.Backend.Publish(m)
+}
+
+// PublishJSON is like Publish, but encodes the message as JSON first.
+func (s *Server) PublishJSON(channel string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Publish(channel, string(data))
+}
+
+// Publishes a message received from a client, if allowed.
+func (s *Server) clientPublish(identity *Identity, auth ClientMessage, channel, body string) error {
+	if !s.canPublish(identity, auth, channel, body) {
+		return errors.New("Publish refused")
+	}
+	return s.Publish(channel, body)
+}
+
 type Stats struct {
 	// Number of active connections
 	Connections int
 
 	// For debugging purposes only
 	LocalSubscriptions map[string]int
+	LocalPatterns      map[string]int
 }
 
 func (s *Server) Stats() (Stats, error) {
@@ -146,7 +454,7 @@ func (s *Server) Stats() (Stats, error) {
 		return Stats{}, err
 	}
 
-	connected, err := s.redis.GetConnected()
+	connected, err := s.Backend.GetConnected()
 	if err != nil {
 		return Stats{}, err
 	}
@@ -154,6 +462,7 @@ func (s *Server) Stats() (Stats, error) {
 	stats := Stats{
 		Connections:        connected,
 		LocalSubscriptions: hubStats.LocalSubscriptions,
+		LocalPatterns:      hubStats.LocalPatterns,
 	}
 
 	return stats, nil
@@ -0,0 +1,72 @@
+package broadcaster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SignChannel grants the user with the given id (see Identity.UserID) access
+// to a channel until expires, without consulting CanSubscribe. Pass the
+// signature to the client, which subscribes with SubscribeSigned. Needs
+// ChannelSecret and an Authenticator.
+//
+// Signatures are bound to the user rather than the session: the client
+// passes them again when it reconnects.
+func (s *Server) SignChannel(userID, channel string, expires time.Time) (string, error) {
+	if len(s.ChannelSecret) == 0 {
+		return "", errors.New("ChannelSecret not set")
+	}
+	if userID == "" {
+		return "", errors.New("Missing user id")
+	}
+	return s.channelSignature(userID, channel, expires.UnixNano()/int64(time.Millisecond)), nil
+}
+
+func (s *Server) channelSignature(userID, channel string, expires int64) string {
+	mac := hmac.New(sha256.New, s.ChannelSecret)
+	fmt.Fprintf(mac, "%s\n%s\n%d", userID, channel, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether a subscribe message carries a valid signature for the channel.
+func (s *Server) verifyChannel(identity *Identity, m ClientMessage) bool {
+	if len(s.ChannelSecret) == 0 || identity == nil || identity.UserID == "" {
+		return false
+	}
+	signature, _ := m["signature"].(string)
+	expires, ok := m["expires"].(float64)
+	if signature == "" || !ok {
+		return false
+	}
+	if time.Now().After(time.Unix(0, int64(expires)*int64(time.Millisecond))) {
+		return false
+	}
+
+	expected := s.channelSignature(identity.UserID, m.Channel(), int64(expires))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// SubscribeSigned passes a signature obtained through Server.SignChannel.
+func SubscribeSigned(signature string, expires time.Time) SubscribeOption {
+	return func(m ClientMessage) {
+		m["signature"] = signature
+		m["expires"] = expires.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// Remembers the signature a channel was subscribed with, to pass it again
+// when resubscribing. Called with channels_lock held.
+func (c *Client) keepSignature(channel string, m ClientMessage) {
+	if _, ok := m["signature"]; !ok {
+		delete(c.signatures, channel)
+		return
+	}
+	c.signatures[channel] = ClientMessage{
+		"signature": m["signature"],
+		"expires":   m["expires"],
+	}
+}
@@ -0,0 +1,485 @@
+package broadcaster
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pborman/uuid"
+)
+
+// Server-Sent Events connection. Authentication and (un)subscribing happens
+// through long-poll POST requests, the event stream replaces the polling.
+type sseConnection struct {
+	pollListener
+
+	Token  string
+	Server *Server
+
+	w       http.ResponseWriter
+	flusher http.Flusher
+
+	// Last sent message id per channel, skips duplicates
+	last_ids map[string]string
+
+	// Resume cursor: event ids are the stream id and a sequence number,
+	// the positions in each channel are kept in the backend.
+	stream_id string
+	seq       int64
+	positions map[string][]ssePosition
+}
+
+// Position in a channel after sending the event with the sequence number.
+type ssePosition struct {
+	seq int64
+	id  string
+}
+
+// Positions kept per channel, besides the one the stream started from.
+const ssePositions = 8
+
+// Event streams are requested with an Accept header (as done by
+// EventSource) or by using the /sse path suffix.
+func isEventStream(r *http.Request) bool {
+	return strings.HasSuffix(r.URL.Path, "/sse") || strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func handleSSEConnection(w http.ResponseWriter, r *http.Request, s *Server) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errors.New("Streaming not supported")
+	}
+
+	token := r.URL.Query().Get("token")
+	connected := false
+	if token != "" {
+		c, err := s.Backend.IsConnected(token)
+		if err != nil {
+			return err
+		}
+		connected = c
+	}
+	if !connected {
+		http.Error(w, "Unknown session", http.StatusUnauthorized)
+		return nil
+	}
+
+	expired, err := s.expireSession(token)
+	if err != nil {
+		return err
+	}
+	if expired {
+		http.Error(w, "Session expired", http.StatusUnauthorized)
+		return nil
+	}
+
+	c := &sseConnection{
+		Token:   token,
+		Server:  s,
+		w:       w,
+		flusher: flusher,
+	}
+	return c.stream(r)
+}
+
+func (c *sseConnection) stream(r *http.Request) error {
+	channels, err := c.start(c.Server, c.Token, c)
+	if err != nil {
+		return err
+	}
+
+	backend := c.Server.Backend
+
+	// Kill other listeners
+	seq := uuid.New()
+	go backend.LongpollTransfer(c.Token, seq)
+
+	c.w.Header().Set("Content-Type", "text/event-stream")
+	c.w.Header().Set("Cache-Control", "no-cache")
+	c.w.WriteHeader(http.StatusOK)
+	c.flusher.Flush()
+
+	// Replay whatever got lost when resuming, duplicates are skipped
+	// based on the last ids.
+	c.resume(lastEventID(r))
+	for _, channel := range channels {
+		since, ok := c.last_ids[channel]
+		if !ok {
+			continue
+		}
+		replay, err := c.Server.history(channel, ClientMessage{"since": since})
+		if err != nil {
+			continue
+		}
+		for _, m := range replay {
+			c.writeEvent(m)
+		}
+	}
+
+	// Ensure we broadcast the backlog
+	go backend.LongpollGetBacklog(c.Token, c.messages)
+
+	keepAlive := time.NewTicker(c.Server.Timeout / 2)
+	c.keepAlive = keepAlive.C
+	c.onKeepAlive = c.ping
+	transferred := false
+	for {
+		c.deadline = c.expiry()
+		transferred = c.listen(seq, r.Context().Done(), c.writeEvent)
+		if transferred || c.closing || r.Context().Err() != nil {
+			break
+		}
+
+		// Credentials expired, unless new ones came in. The client
+		// can't reconnect with expired ones.
+		expired, err := c.Server.sessionExpired(c.Token)
+		if err != nil || expired {
+			c.closing = true
+			break
+		}
+	}
+	keepAlive.Stop()
+
+	if c.closing {
+		c.writeEvent(newMessage(ReconnectMessage))
+	}
+	c.finish(seq, transferred)
+	return nil
+}
+
+// Fires when the credentials of the session expire, nil if they don't.
+func (c *sseConnection) expiry() <-chan time.Time {
+	if c.Server.Authenticator == nil {
+		return nil
+	}
+	_, identity, err := c.Server.session(c.Token)
+	if err != nil || identity == nil || identity.Expires.IsZero() {
+		return nil
+	}
+	return time.After(time.Until(identity.Expires))
+}
+
+// Keeps both the session and proxies in between alive.
+func (c *sseConnection) ping() error {
+	_, err := fmt.Fprint(c.w, ": ping\n\n")
+	if err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return c.Server.Backend.LongpollPing(c.Token)
+}
+
+func (c *sseConnection) writeEvent(m ClientMessage) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	// Messages with an id get an event id, which the client sends back
+	// when resuming.
+	if m.Type() == MessageMessage && m.Pattern() == "" && m.ID() != "" {
+		channel := m.Channel()
+		if idAfter(m.ID(), c.last_ids[channel]) {
+			c.last_ids[channel] = m.ID()
+		} else if !m.NeedsAck() {
+			return nil // Already sent
+		}
+
+		c.seq++
+		c.storePosition(channel, m.ID())
+		_, err = fmt.Fprintf(c.w, "id: %s.%d\n", c.stream_id, c.seq)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(c.w, "data: %s\n\n", data)
+	if err != nil {
+		return err
+	}
+	c.flusher.Flush()
+	return nil
+}
+
+// Last-Event-ID is sent as a header by EventSource, some polyfills use a
+// query parameter instead.
+func lastEventID(r *http.Request) string {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("lastEventId")
+	}
+	return id
+}
+
+// Looks up the positions the client reached in each channel and starts a new
+// cursor from there. Unknown event ids start from scratch.
+func (c *sseConnection) resume(id string) {
+	backend := c.Server.Backend
+
+	c.last_ids = make(map[string]string)
+	fields, err := backend.LongpollGetCursor(c.Token)
+	if id != "" && err == nil {
+		stream, seq := id, int64(-1)
+		if i := strings.LastIndexByte(id, '.'); i >= 0 {
+			stream = id[:i]
+			seq, _ = strconv.ParseInt(id[i+1:], 10, 64)
+		}
+
+		for k, v := range fields {
+			if !strings.HasPrefix(k, "c:") {
+				continue
+			}
+			for _, p := range parsePositions(v) {
+				if stream == fields["stream"] && p.seq <= seq {
+					// Last one the client got
+					c.last_ids[k[2:]] = p.id
+				} else if stream != fields["stream"] && id == fields["from"] && p.seq == 0 {
+					// Nothing came in since resuming last time
+					c.last_ids[k[2:]] = p.id
+				}
+			}
+		}
+	}
+
+	c.stream_id = uuid.New()[:8]
+	c.seq = 0
+	c.positions = make(map[string][]ssePosition)
+	cursor := map[string]string{
+		"stream": c.stream_id,
+		"from":   id,
+	}
+	for channel, last := range c.last_ids {
+		c.positions[channel] = []ssePosition{{0, last}}
+		cursor["c:"+channel] = formatPositions(c.positions[channel])
+	}
+	backend.LongpollStoreCursor(c.Token, cursor, true)
+}
+
+// Records the position in a channel for the current event.
+func (c *sseConnection) storePosition(channel, id string) {
+	positions := append(c.positions[channel], ssePosition{c.seq, id})
+	if n := len(positions); n > ssePositions+1 {
+		if positions[0].seq == 0 {
+			// Keep the start
+			positions = append(positions[:1], positions[n-ssePositions:]...)
+		} else {
+			positions = positions[n-ssePositions:]
+		}
+	}
+	c.positions[channel] = positions
+
+	// Best effort: without it, resuming replays less
+	c.Server.Backend.LongpollStoreCursor(c.Token, map[string]string{
+		"c:" + channel: formatPositions(positions),
+	}, false)
+}
+
+func formatPositions(positions []ssePosition) string {
+	parts := make([]string, 0, len(positions))
+	for _, p := range positions {
+		parts = append(parts, fmt.Sprintf("%d:%s", p.seq, p.id))
+	}
+	return strings.Join(parts, " ")
+}
+
+func parsePositions(s string) []ssePosition {
+	result := make([]ssePosition, 0)
+	for _, part := range strings.Fields(s) {
+		i := strings.IndexByte(part, ':')
+		if i < 0 {
+			continue
+		}
+		seq, err := strconv.ParseInt(part[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		result = append(result, ssePosition{seq, part[i+1:]})
+	}
+	return result
+}
+
+// Whether a message id comes after the last seen id.
+func idAfter(id, last string) bool {
+	if last == "" {
+		return true
+	}
+	a, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return true
+	}
+	b, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return true
+	}
+	return a > b
+}
+
+func (c *sseConnection) GetToken() string {
+	return c.Token
+}
+
+func (c *sseConnection) GetTransport() string {
+	return "sse"
+}
+
+// Client transport, uses long-poll requests for everything but receiving.
+type sseClientTransport struct {
+	*longpollClientTransport
+
+	cancel      context.CancelFunc
+	cancel_lock sync.Mutex
+	lastEventID string
+}
+
+func newSSEClientTransport(c *Client) clientTransport {
+	return &sseClientTransport{
+		longpollClientTransport: newlongpollClientTransport(c).(*longpollClientTransport),
+	}
+}
+
+func (t *sseClientTransport) Close() error {
+	err := t.longpollClientTransport.Close()
+
+	t.cancel_lock.Lock()
+	defer t.cancel_lock.Unlock()
+	if t.cancel != nil {
+		t.cancel()
+	}
+	return err
+}
+
+func (t *sseClientTransport) onConnect() {
+	t.running.Store(true)
+
+	// Can't stream without a session, results of POST requests will
+	// still be received.
+	if t.token != "" {
+		go t.stream()
+	}
+}
+
+func (t *sseClientTransport) mode() ClientMode {
+	return ClientModeSSE
+}
+
+func (t *sseClientTransport) stream() {
+	t.poll_lock.Lock()
+	defer t.poll_lock.Unlock()
+
+	policy := t.client.reconnectPolicy()
+	attempt := 0
+	for t.running.Load() {
+		lastEventID := t.lastEventID
+		connected, err := t.streamOnce()
+		if err == errReconnect {
+			t.finish(err)
+			return
+		}
+		if !t.running.Load() {
+			break
+		}
+		if !connected {
+			t.finish(err)
+			return
+		}
+
+		// Stream got interrupted, resume using the last event id. Back
+		// off while it keeps failing without delivering any events.
+		if t.lastEventID != lastEventID {
+			attempt = 0
+		}
+		attempt++
+		select {
+		case <-time.After(policy.delay(attempt)):
+		case <-t.stop:
+		}
+	}
+
+	t.finish(nil)
+}
+
+// Reads events until the stream ends. Returns whether a stream was opened.
+func (t *sseClientTransport) streamOnce() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	t.cancel_lock.Lock()
+	t.cancel = cancel
+	t.cancel_lock.Unlock()
+
+	u := t.client.url(ClientModeSSE) + "?token=" + url.QueryEscape(t.token)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Accept", "text/event-stream")
+	if t.client.UserAgent != "" {
+		req.Header.Set("User-Agent", t.client.UserAgent)
+	}
+	if t.lastEventID != "" {
+		req.Header.Set("Last-Event-ID", t.lastEventID)
+	}
+
+	resp, err := t.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Non OK status code: %d", resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	id := ""
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return true, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			// Dispatch event
+			if data == "" {
+				continue
+			}
+
+			m := ClientMessage{}
+			err := json.Unmarshal([]byte(data), &m)
+			data = ""
+			if err != nil {
+				return true, err
+			}
+			if id != "" {
+				t.lastEventID = id
+				id = ""
+			}
+
+			if m.Type() == ReconnectMessage {
+				// Server is going away
+				return true, errReconnect
+			}
+			t.push(m)
+		case strings.HasPrefix(line, ":"):
+			// Comment, used for keep-alive
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimPrefix(strings.TrimPrefix(line, "id:"), " ")
+		case strings.HasPrefix(line, "data:"):
+			if data != "" {
+				data += "\n"
+			}
+			data += strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package broadcaster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+func TestSSEClient(t *testing.T) {
+	testClient(t, newSSEClient)
+}
+
+func TestSSECanConnect(t *testing.T) {
+	testCanConnect(t, newSSEClient)
+}
+
+func TestSSERefusesUnauthedCommands(t *testing.T) {
+	testRefusesUnauthedCommands(t, newSSEClient)
+}
+
+func TestSSECanSubscribe(t *testing.T) {
+	testCanSubscribe(t, newSSEClient)
+}
+
+func TestSSEServerPublish(t *testing.T) {
+	testServerPublish(t, newSSEClient)
+}
+
+func TestSSEClientPublish(t *testing.T) {
+	testClientPublish(t, newSSEClient)
+}
+
+func TestSSEHistory(t *testing.T) {
+	testHistory(t, newSSEClient)
+}
+
+func TestSSEMessageIDs(t *testing.T) {
+	testMessageIDs(t, newSSEClient)
+}
+
+func TestSSEPresence(t *testing.T) {
+	testPresence(t, newSSEClient)
+}
+
+func TestSSEClusterStats(t *testing.T) {
+	testClusterStats(t, newSSEClient)
+}
+
+func TestSSEMetrics(t *testing.T) {
+	testMetrics(t, newSSEClient)
+}
+
+func TestSSEShutdown(t *testing.T) {
+	testShutdown(t, newSSEClient)
+}
+
+func TestSSEPatternSubscribe(t *testing.T) {
+	testPatternSubscribe(t, newSSEClient)
+}
+
+func TestSSESubscribeMany(t *testing.T) {
+	testSubscribeMany(t, newSSEClient)
+}
+
+func TestSSEAck(t *testing.T) {
+	testAck(t, newSSEClient)
+}
+
+func TestSSEAutoAck(t *testing.T) {
+	testAutoAck(t, newSSEClient)
+}
+
+func TestSSESubscribeFunc(t *testing.T) {
+	testSubscribeFunc(t, newSSEClient)
+}
+
+func TestSSEContext(t *testing.T) {
+	testContext(t, newSSEClient)
+}
+
+func TestSSEReconnectPolicy(t *testing.T) {
+	testReconnectPolicy(t, newSSEClient)
+}
+
+func TestSSEResubscribeRefused(t *testing.T) {
+	testResubscribeRefused(t, newSSEClient)
+}
+
+func TestSSEState(t *testing.T) {
+	testState(t, newSSEClient)
+}
+
+func TestSSECodec(t *testing.T) {
+	testCodec(t, newSSEClient)
+}
+
+func TestSSEAuthenticator(t *testing.T) {
+	testAuthenticator(t, newSSEClient)
+}
+
+func TestSSESignedChannel(t *testing.T) {
+	testSignedChannel(t, newSSEClient)
+}
+
+func TestSSEHistoryLive(t *testing.T) {
+	testHistoryLive(t, newSSEClient)
+}
+
+func TestSSESubscribeManyLarge(t *testing.T) {
+	testSubscribeManyLarge(t, newSSEClient)
+}
+
+func TestSSEResumeOwnership(t *testing.T) {
+	testResumeOwnership(t, newSSEClient)
+}
+
+func TestSSEConnectResubscribeFails(t *testing.T) {
+	testConnectResubscribeFails(t, newSSEClient)
+}
+
+func TestSSEForgedIdentity(t *testing.T) {
+	testForgedIdentity(t, newSSEClient)
+}
+
+func TestSSEConcurrentPublish(t *testing.T) {
+	testConcurrentPublish(t, newSSEClient)
+}
+
+func TestSSEStreamBackoff(t *testing.T) {
+	server, err := startServer(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Streams end right away, without any events
+	streams := atomic.NewInt64(0)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isEventStream(r) {
+			streams.Inc()
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		server.Broadcaster.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL + "/broadcaster/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Mode = ClientModeSSE
+	client.Reconnect = &ReconnectPolicy{
+		InitialDelay: 100 * time.Millisecond,
+	}
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	// Immediately, then after 100, 200 and 400 milliseconds
+	time.Sleep(500 * time.Millisecond)
+	if n := streams.Load(); n < 2 || n > 5 {
+		t.Errorf("Unexpected number of streams: %d", n)
+	}
+}
+
+func TestSSESlowAck(t *testing.T) {
+	testSlowAck(t, newSSEClient)
+}
+
+func TestSSELastEventID(t *testing.T) {
+	server, err := startServer(&Server{
+		HistoryLength: 10,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	client, err := newSSEClient(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	for _, body := range []string{"One", "Two"} {
+		err = server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		<-client.Messages
+	}
+
+	// Stream id and sequence number, regardless of the channels
+	transport := client.transport.(*sseClientTransport)
+	stream := strings.TrimSuffix(transport.lastEventID, ".2")
+	if len(stream) != 8 || stream+".2" != transport.lastEventID {
+		t.Fatalf("Unexpected last event id: %s", transport.lastEventID)
+	}
+
+	// Resume the stream, pretending we only saw the first message
+	url := fmt.Sprintf("http://localhost:%d/broadcaster/sse?token=%s", server.Port, transport.token)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", stream+".1")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code: %d", resp.StatusCode)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	id, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(id, ".1\n") || strings.Contains(id, stream) {
+		t.Errorf("Unexpected event id: %q", id)
+	}
+	data, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := ClientMessage{}
+	err = json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type() != "message" || m.ID() != "2" || m.Body() != "Two" {
+		t.Errorf("Wrong message payload: %#v", m)
+	}
+}
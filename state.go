@@ -0,0 +1,93 @@
+package broadcaster
+
+// Client connection state, see Client.State.
+type ClientState int
+
+// Connection states
+const (
+	// Not connected yet, or the initial connection failed
+	ClientStateDisconnected ClientState = 0
+
+	// Connecting for the first time
+	ClientStateConnecting ClientState = 1
+
+	// Connected and subscribed
+	ClientStateConnected ClientState = 2
+
+	// Lost the connection, trying to restore it
+	ClientStateReconnecting ClientState = 3
+
+	// Disconnected or gave up on reconnecting, the client can't be used
+	// anymore
+	ClientStateClosed ClientState = 4
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientStateDisconnected:
+		return "disconnected"
+	case ClientStateConnecting:
+		return "connecting"
+	case ClientStateConnected:
+		return "connected"
+	case ClientStateReconnecting:
+		return "reconnecting"
+	case ClientStateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// State returns the current connection state.
+func (c *Client) State() ClientState {
+	c.state_lock.Lock()
+	defer c.state_lock.Unlock()
+	return c.state
+}
+
+// Callbacks are delivered in order on a separate goroutine, so they can use
+// the client (even call Disconnect) without deadlocking.
+func (c *Client) setState(state ClientState) {
+	c.state_lock.Lock()
+	defer c.state_lock.Unlock()
+	if c.state == state || c.state == ClientStateClosed {
+		return
+	}
+	c.state = state
+
+	if c.OnStateChange != nil {
+		c.state_changes = append(c.state_changes, state)
+		if !c.state_notifying {
+			c.state_notifying = true
+			go c.notifyState()
+		}
+	}
+}
+
+// Passes queued state changes to OnStateChange, until there are none left.
+func (c *Client) notifyState() {
+	for {
+		c.state_lock.Lock()
+		if len(c.state_changes) == 0 {
+			c.state_notifying = false
+			c.state_lock.Unlock()
+			return
+		}
+		state := c.state_changes[0]
+		c.state_changes = c.state_changes[1:]
+		c.state_lock.Unlock()
+
+		c.OnStateChange(state)
+	}
+}
+
+// Transport returns the transport in use: ClientModeWebsocket,
+// ClientModeLongPoll or ClientModeSSE. Useful to find out what
+// ClientModeAuto picked. Returns ClientModeAuto when not connected.
+func (c *Client) Transport() ClientMode {
+	transport := c.getTransport()
+	if transport == nil {
+		return ClientModeAuto
+	}
+	return transport.mode()
+}
@@ -0,0 +1,100 @@
+package broadcaster
+
+import "time"
+
+// NodeStats describes the state of a single node, as published in its
+// heartbeat.
+type NodeStats struct {
+	// Node identifier, see Server.NodeID
+	NodeID string `json:"nodeId"`
+
+	// Number of connections, by transport
+	Connections map[string]int `json:"connections"`
+
+	// Number of local subscribers, by channel
+	Subscriptions map[string]int `json:"subscriptions"`
+
+	// Number of messages sent to connections
+	MessagesRelayed int64 `json:"messagesRelayed"`
+
+	// Time of the heartbeat
+	Time time.Time `json:"time"`
+}
+
+// ClusterStats aggregates the stats of all live nodes.
+type ClusterStats struct {
+	// Stats of each node
+	Nodes []NodeStats
+
+	// Number of connections, by transport
+	Connections map[string]int
+
+	// Number of subscribers, by channel
+	Subscriptions map[string]int
+
+	// Number of messages sent to connections
+	MessagesRelayed int64
+}
+
+func (s *Server) nodeStats() (NodeStats, error) {
+	hubStats, err := s.hub.Stats()
+	if err != nil {
+		return NodeStats{}, err
+	}
+
+	return NodeStats{
+		NodeID:          s.NodeID,
+		Connections:     hubStats.Connections,
+		Subscriptions:   hubStats.LocalSubscriptions,
+		MessagesRelayed: hubStats.MessagesRelayed,
+		Time:            time.Now(),
+	}, nil
+}
+
+// Publishes the node stats, they expire when no heartbeat comes in for a
+// few intervals.
+func (s *Server) heartbeat() error {
+	stats, err := s.nodeStats()
+	if err != nil {
+		return err
+	}
+	return s.Backend.StoreNodeStats(stats, 3*s.StatsInterval)
+}
+
+func (s *Server) runHeartbeat() {
+	for {
+		s.heartbeat()
+		s.refreshPresence()
+
+		select {
+		case <-time.After(s.StatsInterval):
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// ClusterStats returns the stats of all live nodes. Nodes that stop sending
+// heartbeats are dropped automatically.
+func (s *Server) ClusterStats() (ClusterStats, error) {
+	nodes, err := s.Backend.GetNodeStats()
+	if err != nil {
+		return ClusterStats{}, err
+	}
+
+	stats := ClusterStats{
+		Nodes:         nodes,
+		Connections:   make(map[string]int),
+		Subscriptions: make(map[string]int),
+	}
+	for _, node := range nodes {
+		for k, v := range node.Connections {
+			stats.Connections[k] += v
+		}
+		for k, v := range node.Subscriptions {
+			stats.Subscriptions[k] += v
+		}
+		stats.MessagesRelayed += node.MessagesRelayed
+	}
+	return stats, nil
+}
@@ -1,6 +1,7 @@
 package broadcaster
 
 import (
+	"strings"
 	"time"
 
 	"github.com/eapache/go-resiliency/retrier"
@@ -19,3 +20,178 @@ func limitWait(dur []time.Duration, max time.Duration) []time.Duration {
 	}
 	return dur
 }
+
+// Longest pattern clients may subscribe to
+const maxPatternLength = 256
+
+// Matches a string against a glob pattern, following the Redis PSUBSCRIBE
+// syntax: * and ? wildcards, [abc] and [a-z] classes ([^a] to negate) and
+// backslash escapes.
+//
+// Only backtracks to the last star, so runs in O(len(pattern) * len(s))
+// whatever the pattern.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(s) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star = p
+			mark = i
+			p++
+			continue
+		}
+		if p < len(pattern) {
+			if ok, width := globMatchOne(pattern[p:], s[i]); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		// Let the last star take one more character
+		p = star + 1
+		mark++
+		i = mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// Matches a single character against the (non-star) token at the start of
+// the pattern, returns the width of the token.
+func globMatchOne(pattern string, c byte) (bool, int) {
+	switch pattern[0] {
+	case '?':
+		return true, 1
+
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end < 0 {
+			// Unterminated class, match literally
+			return c == '[', 1
+		}
+		class := pattern[1 : end+1]
+
+		negate := len(class) > 0 && class[0] == '^'
+		if negate {
+			class = class[1:]
+		}
+		matched := false
+		for i := 0; i < len(class); i++ {
+			if i+2 < len(class) && class[i+1] == '-' {
+				if class[i] <= c && c <= class[i+2] {
+					matched = true
+				}
+				i += 2
+			} else if class[i] == c {
+				matched = true
+			}
+		}
+		return matched != negate, end + 2
+
+	case '\\':
+		if len(pattern) > 1 {
+			return c == pattern[1], 2
+		}
+	}
+	return c == pattern[0], 1
+}
+
+// Whether every channel matched by sub is matched by pattern as well. Errs
+// on the safe side: wildcards in sub only match the same or broader
+// wildcards in pattern.
+func globContains(pattern, sub string) bool {
+	tokens := globTokens(sub)
+	p, i := 0, 0
+	star, mark := -1, 0
+	for i < len(tokens) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star = p
+			mark = i
+			p++
+			continue
+		}
+		if p < len(pattern) && (tokens[i].literal || tokens[i].text != "*") {
+			if ok, width := globMatchToken(pattern[p:], tokens[i]); ok {
+				p += width
+				i++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		p = star + 1
+		mark++
+		i = mark
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// A single character of a pattern, or a wildcard (*, ? or a class).
+type globToken struct {
+	literal bool
+	text    string
+}
+
+func globTokens(pattern string) []globToken {
+	tokens := make([]globToken, 0, len(pattern))
+	for p := 0; p < len(pattern); {
+		width := globTokenWidth(pattern[p:])
+		switch {
+		case pattern[p] == '\\' && width == 2:
+			tokens = append(tokens, globToken{literal: true, text: pattern[p+1 : p+2]})
+		case pattern[p] == '*' || pattern[p] == '?' || width > 1:
+			tokens = append(tokens, globToken{text: pattern[p : p+width]})
+		default:
+			tokens = append(tokens, globToken{literal: true, text: pattern[p : p+1]})
+		}
+		p += width
+	}
+	return tokens
+}
+
+// Matches a token of another pattern against the (non-star) token at the
+// start of the pattern, returns the width of the token.
+func globMatchToken(pattern string, t globToken) (bool, int) {
+	if t.literal {
+		return globMatchOne(pattern, t.text[0])
+	}
+	width := globTokenWidth(pattern)
+	return pattern[:width] == t.text || pattern[0] == '?', width
+}
+
+func globTokenWidth(pattern string) int {
+	switch pattern[0] {
+	case '[':
+		end := strings.IndexByte(pattern[1:], ']')
+		if end >= 0 {
+			return end + 2
+		}
+	case '\\':
+		if len(pattern) > 1 {
+			return 2
+		}
+	}
+	return 1
+}
+
+// Escapes glob special characters
+func globEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,95 @@
+package broadcaster
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGlobMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		match   bool
+	}{
+		{"orders.*", "orders.1", true},
+		{"orders.*", "orders.", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "users.1", false},
+		{"*", "anything/at.all", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"a*b*c", "aXXbYYc", true},
+		{"a*b*c", "aXXbYY", false},
+		{globEscape("bc:msg:") + "orders.*", "bc:msg:orders.1", true},
+		{globEscape("a*[b]") + "*", "a*[b]c", true},
+		{globEscape("a*[b]") + "*", "aX[b]c", false},
+		{"*?", "", false},
+		{"*?", "a", true},
+		{"a*", "a", true},
+		{"*a*b", "xaybzb", true},
+		{"*a*b", "xaybzc", false},
+		{"[abc", "[abc", true},
+	}
+
+	for _, test := range tests {
+		if globMatch(test.pattern, test.s) != test.match {
+			t.Errorf("Expected globMatch(%q, %q) == %v", test.pattern, test.s, test.match)
+		}
+	}
+}
+
+func TestGlobContains(t *testing.T) {
+	tests := []struct {
+		pattern string
+		sub     string
+		match   bool
+	}{
+		{"rooms.*", "rooms.*", true},
+		{"rooms.*", "rooms.1", true},
+		{"rooms.*", "rooms.?", true},
+		{"rooms.*", "rooms.[ab]", true},
+		{"rooms.*", "rooms.*.x", true},
+		{"rooms.?", "rooms.?", true},
+		{"rooms.?", "rooms.*", false},
+		{"rooms.?", "rooms.??", false},
+		{"rooms.[ab]", "rooms.a", true},
+		{"rooms.[ab]", "rooms.?", false},
+		{"rooms.[ab]", "rooms.[ab]", true},
+		{"rooms.1", "rooms.?", false},
+		{"rooms.1", "rooms.1", true},
+		{`rooms.\*`, "rooms.*", false},
+		{`rooms.\*`, `rooms.\*`, true},
+		{"*", "anything*", true},
+		{"a*b", "a*c", false},
+		{"a*b", "a?*b", true},
+		{"users.*", "rooms.*", false},
+	}
+
+	for _, test := range tests {
+		if globContains(test.pattern, test.sub) != test.match {
+			t.Errorf("Expected globContains(%q, %q) == %v", test.pattern, test.sub, test.match)
+		}
+	}
+}
+
+func TestGlobMatchBacktracking(t *testing.T) {
+	pattern := strings.Repeat("*a", 20) + "*b"
+	s := strings.Repeat("a", 40)
+
+	start := time.Now()
+	if globMatch(pattern, s) {
+		t.Error("Expected no match")
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("Matching took too long: %s", d)
+	}
+}
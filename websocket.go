@@ -1,7 +1,7 @@
 package broadcaster
 
 import (
-	"encoding/binary"
+	"context"
 	"errors"
 	"net/http"
 	"sync"
@@ -18,6 +18,19 @@ type websocketConnection struct {
 	Server   *Server
 	AuthData ClientMessage
 
+	// Set when using an Authenticator
+	identity *Identity
+	expiry   *time.Timer
+
+	// Negotiated when authenticating
+	codec Codec
+
+	// Pending messages are stored under it, only the client knows it
+	resume string
+
+	// Broadcasts and notifications
+	queue *sendQueue
+
 	write_lock sync.Mutex
 	read_lock  sync.Mutex
 }
@@ -26,11 +39,13 @@ func newWebsocketConnection(w http.ResponseWriter, r *http.Request, s *Server) {
 	conn := &websocketConnection{
 		Server: s,
 		Token:  uuid.New(),
+		codec:  JSON,
+		resume: uuid.New(),
 	}
 	err := conn.handshake(w, r)
 	if err != nil {
 		if conn.Conn != nil {
-			conn.Conn.WriteJSON(newErrorMessage(ServerErrorMessage, err))
+			conn.writeConn(newErrorMessage(ServerErrorMessage, err))
 			conn.Conn.Close()
 		} else {
 			http.Error(w, err.Error(), 500)
@@ -41,13 +56,34 @@ func newWebsocketConnection(w http.ResponseWriter, r *http.Request, s *Server) {
 func (c *websocketConnection) writeConn(msg ClientMessage) error {
 	c.write_lock.Lock()
 	defer c.write_lock.Unlock()
-	return c.Conn.WriteJSON(msg)
+
+	messageType, data, err := encodeFrame(c.codec, msg)
+	if err != nil {
+		return err
+	}
+
+	// Only compress messages that are large enough to benefit
+	if c.Server.EnableCompression {
+		c.Conn.EnableWriteCompression(len(data) >= c.Server.CompressionThreshold)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.Server.WriteTimeout))
+	return c.Conn.WriteMessage(messageType, data)
+}
+
+// Replies to a request.
+func (c *websocketConnection) reply(request, m ClientMessage) error {
+	return c.writeConn(newReply(request, m))
 }
 
 func (c *websocketConnection) readConn(v interface{}) error {
 	c.read_lock.Lock()
 	defer c.read_lock.Unlock()
-	return c.Conn.ReadJSON(v)
+
+	messageType, data, err := c.Conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return decodeFrame(c.codec, messageType, data, v)
 }
 
 func (c *websocketConnection) handshake(w http.ResponseWriter, r *http.Request) error {
@@ -57,6 +93,10 @@ func (c *websocketConnection) handshake(w http.ResponseWriter, r *http.Request)
 		return nil
 	}
 	c.Conn = conn
+	conn.SetReadLimit(c.Server.MaxMessageSize)
+	if c.Server.EnableCompression {
+		conn.SetCompressionLevel(c.Server.CompressionLevel)
+	}
 
 	err = c.readConn(&c.AuthData)
 	if err != nil {
@@ -71,43 +111,78 @@ func (c *websocketConnection) handshake(w http.ResponseWriter, r *http.Request)
 		return nil
 	}
 
-	if c.Server.CanConnect != nil && !c.Server.CanConnect(c.AuthData) {
-		c.writeConn(newErrorMessage(AuthFailedMessage, errors.New("Unauthorized")))
-		c.Close(4401, "Unauthorized")
+	identity, err := c.Server.authenticate(c.AuthData)
+	if err != nil {
+		c.Server.metrics.connectFailures.Inc()
+		c.writeConn(newErrorMessage(AuthFailedMessage, err))
+		c.Close(4401, err.Error())
 		return nil
 	}
+	c.identity = identity
 
-	redis := c.Server.redis
-	err = redis.StoreSession(c.Token, c.AuthData)
+	backend := c.Server.Backend
+	err = backend.StoreSession(c.Token, sessionData(c.AuthData, identity, c.resume))
 	if err != nil {
 		c.writeConn(newMessage(ServerErrorMessage))
 		conn.Close()
 		return nil
 	}
 
-	defer c.Cleanup()
-
-	err = c.writeConn(newMessage(AuthOKMessage))
+	reply := withExpiry(ClientMessage{"__type": AuthOKMessage, "__token": c.Token, resumeKey: c.resume}, identity)
+	codec := JSON
+	if name := c.AuthData.Codec(); name != "" {
+		codec = c.Server.codec(name)
+		reply["__codec"] = codec.Name()
+	}
+	c.AuthData = clientData(c.AuthData)
+	err = c.writeConn(reply)
 	if err != nil {
+		backend.DeleteSession(c.Token)
 		return err
 	}
 
-	hub := c.Server.hub
-	err = hub.Connect(c)
+	// Switch once the client knows
+	c.write_lock.Lock()
+	c.codec = codec
+	c.write_lock.Unlock()
+
+	c.queue = newSendQueue(c.Server, c.Token, c.resume, c.writeConn, c.overflow)
+	err = c.Server.register(c)
 	if err != nil {
-		return err
+		c.queue.stop()
+		backend.DeleteSession(c.Token)
+		c.Close(websocket.CloseGoingAway, err.Error())
+		return nil
 	}
+	defer c.Server.active.Done()
+	defer c.Cleanup()
 
+	c.watchExpiry()
 	c.Run()
 
 	return nil
 }
 
+// Closes the connection once the credentials expire, unless new ones come in
+// before that.
+func (c *websocketConnection) watchExpiry() {
+	if c.expiry != nil {
+		c.expiry.Stop()
+		c.expiry = nil
+	}
+	if c.identity == nil || c.identity.Expires.IsZero() {
+		return
+	}
+	c.expiry = time.AfterFunc(time.Until(c.identity.Expires), func() {
+		c.Close(4401, "Session expired")
+	})
+}
+
 func (c *websocketConnection) Run() {
 	hub := c.Server.hub
 
-	m := ClientMessage{}
 	for {
+		m := ClientMessage{}
 		err := c.readConn(&m)
 		if err != nil {
 			c.Close(4400, err.Error())
@@ -117,42 +192,196 @@ func (c *websocketConnection) Run() {
 		switch m.Type() {
 		case SubscribeMessage:
 			channel := m.Channel()
-			if c.Server.CanSubscribe != nil && !c.Server.CanSubscribe(c.AuthData, channel) {
-				c.writeConn(newChannelErrorMessage(SubscribeErrorMessage, channel, errors.New("Channel refused")))
+			replay, err := c.subscribeChannel(m)
+			if err != nil {
+				c.reply(m, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
 				continue
 			}
 
-			err := hub.Subscribe(c, channel)
-			if err != nil {
-				c.writeConn(newChannelErrorMessage(SubscribeErrorMessage, channel, err))
-			} else {
-				c.writeConn(newChannelMessage(SubscribeOKMessage, channel))
+			c.reply(m, newSubscribeOKMessage(channel, replay))
+			c.queue.release(channel, replay)
+
+		case SubscribeManyMessage:
+			if results := refuseBatch(m, SubscribeErrorMessage); results != nil {
+				c.reply(m, newBatchMessage(SubscribeManyResultMessage, m, results))
+				continue
+			}
+			results := make([]ClientMessage, 0)
+			replay := make(map[string][]ClientMessage)
+			for _, entry := range m.Channels() {
+				channel := entry.Channel()
+				r, err := c.subscribeChannel(entry)
+				if err != nil {
+					results = append(results, newChannelErrorMessage(SubscribeErrorMessage, channel, err))
+					continue
+				}
+				results = append(results, newSubscribeOKMessage(channel, r))
+				replay[channel] = r
+			}
+
+			c.reply(m, newBatchMessage(SubscribeManyResultMessage, m, results))
+			for _, entry := range m.Channels() {
+				if r, ok := replay[entry.Channel()]; ok {
+					c.queue.release(entry.Channel(), r)
+				}
 			}
 
 		case UnsubscribeMessage:
 			channel := m.Channel()
+			err := c.unsubscribeChannel(channel)
+			if err != nil {
+				c.reply(m, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+				continue
+			}
+			c.reply(m, newChannelMessage(UnsubscribeOKMessage, channel))
+
+		case UnsubscribeManyMessage:
+			if results := refuseBatch(m, UnsubscribeErrorMessage); results != nil {
+				c.reply(m, newBatchMessage(UnsubscribeManyResultMessage, m, results))
+				continue
+			}
+			results := make([]ClientMessage, 0)
+			for _, entry := range m.Channels() {
+				channel := entry.Channel()
+				err := c.unsubscribeChannel(channel)
+				if err != nil {
+					results = append(results, newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+					continue
+				}
+				results = append(results, newChannelMessage(UnsubscribeOKMessage, channel))
+			}
+			c.reply(m, newBatchMessage(UnsubscribeManyResultMessage, m, results))
+
+		case PSubscribeMessage:
+			pattern := m.Channel()
+			if !c.Server.canPSubscribe(c.identity, c.AuthData, pattern) {
+				c.Server.metrics.subscribeFailures.Inc()
+				c.reply(m, newChannelErrorMessage(PSubscribeErrorMessage, pattern, errors.New("Channel refused")))
+				continue
+			}
+
+			err := hub.PSubscribe(c, pattern)
+			if err != nil {
+				c.reply(m, newChannelErrorMessage(PSubscribeErrorMessage, pattern, err))
+				continue
+			}
+			c.Server.metrics.subscribes.Inc()
+			c.reply(m, newChannelMessage(PSubscribeOKMessage, pattern))
+
+		case PUnsubscribeMessage:
+			pattern := m.Channel()
+
+			err := hub.PUnsubscribe(c, pattern)
+			if err != nil {
+				c.reply(m, newChannelErrorMessage(PUnsubscribeErrorMessage, pattern, err))
+				continue
+			}
+			c.Server.metrics.unsubscribes.Inc()
+			c.reply(m, newChannelMessage(PUnsubscribeOKMessage, pattern))
+
+		case PublishMessage:
+			channel := m.Channel()
 
-			err := hub.Unsubscribe(c, channel)
+			err := c.Server.clientPublish(c.identity, c.AuthData, channel, m.Body())
 			if err != nil {
-				c.writeConn(newChannelErrorMessage(UnsubscribeErrorMessage, channel, err))
+				c.reply(m, newChannelErrorMessage(PublishErrorMessage, channel, err))
 				continue
 			}
-			c.writeConn(newChannelMessage(UnsubscribeOKMessage, channel))
+			c.reply(m, newChannelMessage(PublishOKMessage, channel))
+
+		case AckMessage:
+			err := c.Server.ack(c.resume, m)
+			if err != nil {
+				c.reply(m, newErrorMessage(ServerErrorMessage, err))
+			}
+
+		case ReauthMessage:
+			identity, err := c.Server.reauthenticate(c.identity, m)
+			if err != nil {
+				c.Server.metrics.connectFailures.Inc()
+				c.reply(m, newErrorMessage(ReauthErrorMessage, err))
+				continue
+			}
+			err = c.Server.Backend.UpdateSession(c.Token, sessionData(m, identity, c.resume))
+			if err != nil {
+				c.reply(m, newErrorMessage(ReauthErrorMessage, err))
+				continue
+			}
+
+			c.AuthData = clientData(m)
+			c.identity = identity
+			c.watchExpiry()
+			c.reply(m, withExpiry(newMessage(ReauthOKMessage), identity))
 
 		case PingMessage:
 			// Do nothing
 
 		default:
-			c.writeConn(newMessage(UnknownMessage))
+			c.reply(m, newMessage(UnknownMessage))
 		}
 	}
 }
 
+// Subscribes to a channel, returns the messages that should be replayed.
+// Live messages on the channel are held back until the caller releases them
+// along with the replay, once the result has been sent.
+func (c *websocketConnection) subscribeChannel(m ClientMessage) ([]ClientMessage, error) {
+	hub := c.Server.hub
+
+	channel := m.Channel()
+	if !c.Server.verifyChannel(c.identity, m) && !c.Server.canSubscribe(c.identity, c.AuthData, channel) {
+		c.Server.metrics.subscribeFailures.Inc()
+		return nil, errors.New("Channel refused")
+	}
+
+	c.queue.hold(channel)
+	err := hub.Subscribe(c, channel)
+	if err != nil {
+		c.queue.release(channel, nil)
+		return nil, err
+	}
+
+	replay, err := c.Server.history(channel, m)
+	if err == nil {
+		err = c.Server.join(c.AuthData, c.Token, channel)
+	}
+	if err == nil {
+		var pending []ClientMessage
+		pending, err = c.Server.resume(c.resume, channel, m)
+		replay = mergeReplay(replay, pending)
+	}
+	if err != nil {
+		hub.Unsubscribe(c, channel)
+		c.queue.release(channel, nil)
+		return nil, err
+	}
+
+	c.Server.metrics.subscribes.Inc()
+	return replay, nil
+}
+
+func (c *websocketConnection) unsubscribeChannel(channel string) error {
+	err := c.Server.hub.Unsubscribe(c, channel)
+	if err == nil {
+		err = c.Server.leave(c.Token, channel)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.Server.metrics.unsubscribes.Inc()
+	return nil
+}
+
 func (c *websocketConnection) Cleanup() {
-	redis := c.Server.redis
+	backend := c.Server.Backend
 	hub := c.Server.hub
 
-	err := redis.DeleteSession(c.Token)
+	for _, channel := range hub.connectionChannels(c) {
+		c.Server.leave(c.Token, channel)
+	}
+
+	err := backend.DeleteSession(c.Token)
 	if err != nil {
 		c.writeConn(newErrorMessage(ServerErrorMessage, err))
 	}
@@ -161,20 +390,40 @@ func (c *websocketConnection) Cleanup() {
 	if err != nil {
 		c.writeConn(newErrorMessage(ServerErrorMessage, err))
 	}
+	if c.expiry != nil {
+		c.expiry.Stop()
+	}
 
+	// Fails a pending write, so the queue can be drained right away.
+	// What's left in there is stored as pending when it needs an ack.
 	c.Conn.Close()
+	c.queue.drain()
 }
 
-func (c *websocketConnection) Close(code uint16, msg string) {
-	payload := make([]byte, 2)
-	binary.BigEndian.PutUint16(payload, code)
-	payload = append(payload, []byte(msg)...)
-	c.Conn.WriteMessage(websocket.CloseMessage, payload)
+// Doesn't wait for the write lock, a pending write to a slow client can hold
+// it for a long time.
+func (c *websocketConnection) Close(code int, msg string) {
+	payload := websocket.FormatCloseMessage(code, msg)
+	c.Conn.WriteControl(websocket.CloseMessage, payload, time.Now().Add(time.Second))
 	c.Conn.Close()
 }
 
-func (c *websocketConnection) Send(channel, message string) {
-	c.writeConn(newBroadcastMessage(channel, message))
+// Closes a connection that can't keep up.
+func (c *websocketConnection) overflow() {
+	c.Close(c.Server.OverflowCloseCode, "Send queue full")
+}
+
+func (c *websocketConnection) Send(m Message) {
+	c.queue.Send(m)
+}
+
+func (c *websocketConnection) Notify(m ClientMessage) {
+	c.queue.Notify(m)
+}
+
+func (c *websocketConnection) Shutdown() {
+	// Stops Run, which will clean up the connection.
+	c.Close(websocket.CloseGoingAway, "Server shutting down")
 }
 
 func (c *websocketConnection) Process(t string, args []string) {
@@ -185,6 +434,10 @@ func (c *websocketConnection) GetToken() string {
 	return c.Token
 }
 
+func (c *websocketConnection) GetTransport() string {
+	return "websocket"
+}
+
 // Client transport
 type websocketClientTransport struct {
 	conn      *websocket.Conn
@@ -192,6 +445,9 @@ type websocketClientTransport struct {
 	client    *Client
 	running   *atomic.Bool
 
+	// Negotiated when authenticating
+	codec Codec
+
 	write_lock sync.Mutex
 	read_lock  sync.Mutex
 }
@@ -200,28 +456,70 @@ func newWebsocketClientTransport(c *Client) clientTransport {
 	return &websocketClientTransport{
 		running: atomic.NewBool(false),
 		client:  c,
+		codec:   JSON,
 	}
 }
 
-func (t *websocketClientTransport) writeConn(msg ClientMessage) error {
+func (t *websocketClientTransport) writeConn(ctx context.Context, msg ClientMessage) error {
 	t.write_lock.Lock()
 	defer t.write_lock.Unlock()
-	return t.conn.WriteJSON(msg)
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		t.conn.SetWriteDeadline(deadline)
+		defer t.conn.SetWriteDeadline(time.Time{})
+	}
+
+	messageType, data, err := encodeFrame(t.codec, msg)
+	if err != nil {
+		return err
+	}
+
+	// Closes the connection when cancelled during the write, a partial
+	// frame can't be recovered from. The client reconnects.
+	if ctx.Done() != nil {
+		written := make(chan struct{})
+		defer close(written)
+		go func() {
+			select {
+			case <-ctx.Done():
+				t.conn.Close()
+			case <-written:
+			}
+		}()
+	}
+
+	err = t.conn.WriteMessage(messageType, data)
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
 }
 
 func (t *websocketClientTransport) readConn(v interface{}) error {
 	t.read_lock.Lock()
 	defer t.read_lock.Unlock()
-	return t.conn.ReadJSON(v)
+
+	messageType, data, err := t.conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+	return decodeFrame(t.codec, messageType, data, v)
 }
 
-func (t *websocketClientTransport) Connect(authData ClientMessage) error {
+func (t *websocketClientTransport) Connect(ctx context.Context, authData ClientMessage) error {
 	var header http.Header = nil
 	if t.client.UserAgent != "" {
 		header = make(http.Header)
 		header.Set("User-Agent", t.client.UserAgent)
 	}
-	conn, _, err := websocket.DefaultDialer.Dial(t.client.url(ClientModeWebsocket), header)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = t.client.EnableCompression
+	conn, _, err := dialer.DialContext(ctx, t.client.url(ClientModeWebsocket), header)
 	if err != nil {
 		return err
 	}
@@ -237,7 +535,10 @@ func (t *websocketClientTransport) Connect(authData ClientMessage) error {
 			data = make(ClientMessage)
 		}
 		data["__type"] = AuthMessage
-		err := t.Send(data)
+		if t.client.Codec != nil {
+			data["__codec"] = t.client.Codec.Name()
+		}
+		err := t.Send(ctx, data)
 		if err != nil {
 			return err
 		}
@@ -250,7 +551,7 @@ func (t *websocketClientTransport) Connect(authData ClientMessage) error {
 			if !t.running.Load() {
 				return
 			}
-			t.Send(newMessage(PingMessage))
+			t.Send(context.Background(), newMessage(PingMessage))
 		}
 	}()
 
@@ -268,8 +569,8 @@ func (t *websocketClientTransport) Close() error {
 	return t.conn.Close()
 }
 
-func (t *websocketClientTransport) Send(data ClientMessage) error {
-	return t.writeConn(data)
+func (t *websocketClientTransport) Send(ctx context.Context, data ClientMessage) error {
+	return t.writeConn(ctx, data)
 }
 
 func (t *websocketClientTransport) Receive() (ClientMessage, error) {
@@ -282,8 +583,32 @@ func (t *websocketClientTransport) Receive() (ClientMessage, error) {
 			Text: cerr.Text,
 		}
 	}
+	if err == nil && m.Type() == AuthFailedMessage {
+		return nil, &CloseError{
+			Code: 4401,
+			Text: m.Reason(),
+		}
+	}
+	if err == nil && m.Type() == AuthOKMessage {
+		t.setCodec(m.Codec())
+	}
 	return m, err
 }
 
+// Switches to the codec accepted by the server.
+func (t *websocketClientTransport) setCodec(name string) {
+	if t.client.Codec == nil || t.client.Codec.Name() != name {
+		return
+	}
+
+	t.write_lock.Lock()
+	defer t.write_lock.Unlock()
+	t.codec = t.client.Codec
+}
+
 func (t *websocketClientTransport) onConnect() {
 }
+
+func (t *websocketClientTransport) mode() ClientMode {
+	return ClientModeWebsocket
+}
@@ -1,6 +1,17 @@
 package broadcaster
 
-import "testing"
+import (
+	"compress/flate"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
 
 func TestWSClient(t *testing.T) {
 	testClient(t, newWSClient)
@@ -17,3 +28,362 @@ func TestWSRefusesUnauthedCommands(t *testing.T) {
 func TestWSCanSubscribe(t *testing.T) {
 	testCanSubscribe(t, newWSClient)
 }
+
+func TestWSServerPublish(t *testing.T) {
+	testServerPublish(t, newWSClient)
+}
+
+func TestWSClientPublish(t *testing.T) {
+	testClientPublish(t, newWSClient)
+}
+
+func TestWSHistory(t *testing.T) {
+	testHistory(t, newWSClient)
+}
+
+func TestWSMessageIDs(t *testing.T) {
+	testMessageIDs(t, newWSClient)
+}
+
+func TestWSPresence(t *testing.T) {
+	testPresence(t, newWSClient)
+}
+
+func TestWSClusterStats(t *testing.T) {
+	testClusterStats(t, newWSClient)
+}
+
+func TestWSMetrics(t *testing.T) {
+	testMetrics(t, newWSClient)
+}
+
+func TestWSShutdown(t *testing.T) {
+	testShutdown(t, newWSClient)
+}
+
+func TestWSPatternSubscribe(t *testing.T) {
+	testPatternSubscribe(t, newWSClient)
+}
+
+func TestWSSubscribeMany(t *testing.T) {
+	testSubscribeMany(t, newWSClient)
+}
+
+func TestWSAck(t *testing.T) {
+	testAck(t, newWSClient)
+}
+
+func TestWSAutoAck(t *testing.T) {
+	testAutoAck(t, newWSClient)
+}
+
+func TestWSSubscribeFunc(t *testing.T) {
+	testSubscribeFunc(t, newWSClient)
+}
+
+func TestWSContext(t *testing.T) {
+	testContext(t, newWSClient)
+}
+
+func TestWSReconnectPolicy(t *testing.T) {
+	testReconnectPolicy(t, newWSClient)
+}
+
+func TestWSResubscribeRefused(t *testing.T) {
+	testResubscribeRefused(t, newWSClient)
+}
+
+func TestWSState(t *testing.T) {
+	testState(t, newWSClient)
+}
+
+func TestWSCodec(t *testing.T) {
+	testCodec(t, newWSClient)
+}
+
+func TestWSAuthenticator(t *testing.T) {
+	testAuthenticator(t, newWSClient)
+}
+
+func TestWSSignedChannel(t *testing.T) {
+	testSignedChannel(t, newWSClient)
+}
+
+func TestWSHistoryLive(t *testing.T) {
+	testHistoryLive(t, newWSClient)
+}
+
+func TestWSSubscribeManyLarge(t *testing.T) {
+	testSubscribeManyLarge(t, newWSClient)
+}
+
+func TestWSResumeOwnership(t *testing.T) {
+	testResumeOwnership(t, newWSClient)
+}
+
+// A cancelled context interrupts a stalled write.
+func TestWSWriteCancel(t *testing.T) {
+	release := make(chan struct{})
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		<-release // Never reads
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	conn, _, err := websocket.DefaultDialer.Dial(strings.Replace(srv.URL, "http", "ws", 1), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &websocketClientTransport{conn: conn, codec: JSON}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	body := strings.Repeat("x", 1<<20)
+	done := make(chan error, 1)
+	go func() {
+		for {
+			err := transport.writeConn(ctx, ClientMessage{"__type": PublishMessage, "body": body})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("Expected cancel error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write not interrupted")
+	}
+}
+
+func TestWSConnectResubscribeFails(t *testing.T) {
+	testConnectResubscribeFails(t, newWSClient)
+}
+
+func TestWSMaxMessageSize(t *testing.T) {
+	server, err := startServer(&Server{
+		MaxMessageSize: 1000,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(ClientMessage{"__type": AuthMessage, "data": strings.Repeat("x", 2000)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+}
+
+// Shutting down doesn't wait for writes to clients that stopped reading.
+func TestWSShutdownStalled(t *testing.T) {
+	server, err := startServer(&Server{
+		WriteTimeout: time.Minute,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, m := range []ClientMessage{
+		{"__type": AuthMessage},
+		{"__type": SubscribeMessage, "channel": "test"},
+	} {
+		err = conn.WriteJSON(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Never read again
+	body := strings.Repeat("x", 1<<20)
+	for i := 0; i < 20; i++ {
+		err = server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-time.After(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Broadcaster.Shutdown(ctx)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked")
+	}
+}
+
+// Messages that need an ack and are still queued when the client goes away
+// are kept as pending.
+func TestWSDisconnectQueued(t *testing.T) {
+	server, err := startServer(&Server{
+		WriteTimeout: time.Minute,
+		RequireAck: func(channel string) bool {
+			return true
+		},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	resume := ""
+	for _, m := range []ClientMessage{
+		{"__type": AuthMessage},
+		{"__type": SubscribeMessage, "channel": "test"},
+	} {
+		err = conn.WriteJSON(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply := ClientMessage{}
+		err = conn.ReadJSON(&reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Type() == AuthOKMessage {
+			resume, _ = reply[resumeKey].(string)
+		}
+	}
+	if resume == "" {
+		t.Fatal("Expected resume key")
+	}
+
+	// Stop reading until the queue backs up, then go away
+	body := strings.Repeat("x", 1<<20)
+	for i := 0; i < 20; i++ {
+		err = server.Broadcaster.Publish("test", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-time.After(200 * time.Millisecond)
+	conn.Close()
+
+	count := 0
+	for i := 0; i < 50; i++ {
+		pending, err := server.Broadcaster.Backend.GetPending([]string{resume})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count = len(pending[resume])
+		if count == 20 {
+			return
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+	t.Errorf("Expected 20 pending messages, got %d", count)
+}
+
+func TestWSForgedIdentity(t *testing.T) {
+	testForgedIdentity(t, newWSClient)
+}
+
+func TestWSConcurrentPublish(t *testing.T) {
+	testConcurrentPublish(t, newWSClient)
+}
+
+func TestWSSlowAck(t *testing.T) {
+	testSlowAck(t, newWSClient)
+}
+
+func TestWSCompression(t *testing.T) {
+	server, err := startServer(&Server{
+		EnableCompression:    true,
+		CompressionLevel:     flate.BestSpeed,
+		CompressionThreshold: 100,
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	// Negotiated when the client asks for it
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(fmt.Sprintf("ws://localhost:%d/broadcaster/", server.Port), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+		t.Errorf("Compression not negotiated: %#v", resp.Header)
+	}
+
+	client, err := newWSClient(server, func(c *Client) {
+		c.EnableCompression = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Disconnect()
+
+	err = client.Subscribe("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ready := false
+	for !ready {
+		stats, _ := server.Broadcaster.Stats()
+		if stats.LocalSubscriptions["test"] != 1 {
+			<-time.After(100 * time.Millisecond)
+		} else {
+			ready = true
+		}
+	}
+
+	body := strings.Repeat("Large message ", 100)
+	for _, b := range []string{"Small", body} {
+		err = server.Broadcaster.Publish("test", b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		m := <-client.Messages
+		if m.Body() != b {
+			t.Errorf("Wrong message payload: %#v", m)
+		}
+	}
+}